@@ -0,0 +1,85 @@
+package conn
+
+import (
+	"sync"
+	"time"
+)
+
+// ackTracker records the messages sent to the broker which have not been
+// acknowledged yet, and measures the round trip time of those which have.
+type ackTracker struct {
+	mu      sync.Mutex
+	pending []sentMsg
+	rtt     time.Duration
+}
+
+type sentMsg struct {
+	id int32
+	at time.Time
+}
+
+// sent records that the message with the specified id was sent at time at.
+func (a *ackTracker) sent(id int32, at time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending = append(a.pending, sentMsg{id: id, at: at})
+}
+
+// ack marks the message with the specified id, and all messages sent
+// before it, as acknowledged at time at. The id need not be pending itself,
+// as pings and ack-only messages are not tracked. The round trip time is
+// sampled from the newest message acknowledged. It returns false if no
+// pending message was acknowledged.
+func (a *ackTracker) ack(id int32, at time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	n := 0
+	for n < len(a.pending) && !after(a.pending[n].id, id) {
+		n++
+	}
+	if n == 0 {
+		return false
+	}
+
+	// Smooth the round trip time the same way TCP does.
+	sample := at.Sub(a.pending[n-1].at)
+	if a.rtt == 0 {
+		a.rtt = sample
+	} else {
+		a.rtt += (sample - a.rtt) / 8
+	}
+	a.pending = append(a.pending[:0], a.pending[n:]...)
+	return true
+}
+
+// after reports whether the message id a was sent after b, allowing for the
+// ids wrapping around at maxMsgId.
+func after(a, b int32) bool {
+	d := a - b
+	if d < 0 {
+		d += maxMsgId
+	}
+	return d != 0 && d < maxMsgId/2
+}
+
+// unacked returns the number of messages waiting to be acknowledged.
+func (a *ackTracker) unacked() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.pending)
+}
+
+// latency returns the smoothed round trip time of acknowledged messages.
+func (a *ackTracker) latency() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rtt
+}
+
+// reset forgets all pending messages. The round trip time is kept.
+func (a *ackTracker) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending = nil
+}
@@ -0,0 +1,57 @@
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAckTracker(t *testing.T) {
+	var a ackTracker
+	now := time.Now()
+
+	for i := int32(1); i <= 4; i++ {
+		a.sent(i, now)
+	}
+	if n := a.unacked(); n != 4 {
+		t.Errorf("unacked() == %d, want 4", n)
+	}
+
+	if !a.ack(2, now.Add(80*time.Millisecond)) {
+		t.Error("ack(2) == false, want true")
+	}
+	if n := a.unacked(); n != 2 {
+		t.Errorf("unacked() after ack(2) == %d, want 2", n)
+	}
+	if l := a.latency(); l != 80*time.Millisecond {
+		t.Errorf("latency() == %v, want %v", l, 80*time.Millisecond)
+	}
+
+	if a.ack(1, now) {
+		t.Error("ack(1) after ack(2) == true, want false")
+	}
+
+	// An ack of an untracked later message, such as a ping, acknowledges
+	// everything sent before it.
+	if !a.ack(6, now.Add(160*time.Millisecond)) {
+		t.Error("ack(6) == false, want true")
+	}
+	if n := a.unacked(); n != 0 {
+		t.Errorf("unacked() after ack(6) == %d, want 0", n)
+	}
+	if l := a.latency(); l != 90*time.Millisecond {
+		t.Errorf("latency() == %v, want %v", l, 90*time.Millisecond)
+	}
+
+	// Ids wrap around at maxMsgId.
+	a.sent(maxMsgId-1, now)
+	a.sent(maxMsgId, now)
+	a.sent(1, now)
+	a.ack(maxMsgId, now)
+	if n := a.unacked(); n != 1 {
+		t.Errorf("unacked() after ack(maxMsgId) == %d, want 1", n)
+	}
+	a.ack(2, now)
+	if n := a.unacked(); n != 0 {
+		t.Errorf("unacked() after ack(2) == %d, want 0", n)
+	}
+}
@@ -0,0 +1,51 @@
+package conn
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+)
+
+// backoff calculates exponentially increasing delays between reconnect
+// attempts. Each delay is randomly jittered so that many links which lose
+// their connection at the same time do not reconnect in lock step.
+type backoff struct {
+	min time.Duration
+	max time.Duration
+	cur time.Duration
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	if min <= 0 {
+		min = minReconnectDelay
+	}
+	if max < min {
+		max = min
+	}
+	return &backoff{min: min, max: max}
+}
+
+// Next returns the delay to wait before the next attempt. The returned
+// value is between half and all of the current delay.
+func (b *backoff) Next() time.Duration {
+	if b.cur == 0 {
+		b.cur = b.min
+	} else {
+		b.cur *= 2
+		if b.cur > b.max {
+			b.cur = b.max
+		}
+	}
+
+	half := b.cur / 2
+	return half + time.Duration(rand.Int63n(int64(b.cur-half)+1))
+}
+
+// Reset returns the backoff to its minimum delay.
+func (b *backoff) Reset() {
+	b.cur = 0
+}
@@ -0,0 +1,25 @@
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(time.Second, 8*time.Second)
+
+	var want = []time.Duration{1, 2, 4, 8, 8}
+	for i, w := range want {
+		w *= time.Second
+		got := b.Next()
+		if got < w/2 || got > w {
+			t.Errorf("Next() #%d == %v, want between %v and %v", i, got, w/2, w)
+		}
+	}
+
+	b.Reset()
+	got := b.Next()
+	if got < time.Second/2 || got > time.Second {
+		t.Errorf("Next() after Reset == %v, want between %v and %v", got, time.Second/2, time.Second)
+	}
+}
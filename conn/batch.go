@@ -0,0 +1,98 @@
+package conn
+
+import (
+	"encoding/json"
+
+	"github.com/butlermatt/dslink"
+)
+
+const defaultMaxMsgSize = 64 * 1024
+
+// batch collects outgoing responses and requests so they can be sent to the
+// broker in a single message. Subscription updates are merged into a single
+// response, and only the latest update is kept for each QoS 0 subscription.
+type batch struct {
+	qos   func(sid int32) uint8
+	resps []*dslink.Response
+	reqs  []*dslink.Request
+	subs  *dslink.Response
+	sids  map[int32]int
+	size  int
+}
+
+func newBatch(qos func(sid int32) uint8) *batch {
+	return &batch{qos: qos}
+}
+
+func (b *batch) empty() bool {
+	return len(b.resps) == 0 && len(b.reqs) == 0
+}
+
+// full returns true if the batch has reached max bytes. A max of 0 or less is
+// unlimited.
+func (b *batch) full(max int) bool {
+	return max > 0 && b.size >= max
+}
+
+func (b *batch) addRequest(r *dslink.Request) {
+	b.reqs = append(b.reqs, r)
+	b.size += estimateSize(r)
+}
+
+func (b *batch) addResponse(r *dslink.Response) {
+	if r.Rid != 0 {
+		b.resps = append(b.resps, r)
+		b.size += estimateSize(r)
+		return
+	}
+
+	if b.subs == nil {
+		b.subs = dslink.NewResp(0)
+		b.sids = make(map[int32]int)
+		b.resps = append(b.resps, b.subs)
+	}
+
+	for _, u := range r.Updates {
+		sid, ok := updateSid(u)
+		if ok && b.qos(sid) == 0 {
+			if i, ok := b.sids[sid]; ok {
+				b.subs.Updates[i] = u
+				continue
+			}
+			b.sids[sid] = len(b.subs.Updates)
+		}
+		b.subs.Updates = append(b.subs.Updates, u)
+		b.size += estimateSize(u)
+	}
+}
+
+// message returns the contents of the batch as a single message and resets
+// the batch.
+func (b *batch) message() *dslink.Message {
+	m := &dslink.Message{Resp: b.resps, Reqs: b.reqs}
+	b.resps = nil
+	b.reqs = nil
+	b.subs = nil
+	b.sids = nil
+	b.size = 0
+	return m
+}
+
+// updateSid returns the sid of a subscription value update.
+func updateSid(u interface{}) (int32, bool) {
+	m, ok := u.(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	sid, ok := m["sid"].(int32)
+	return sid, ok
+}
+
+// estimateSize returns the approximate encoded size of v in bytes.
+func estimateSize(v interface{}) int {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return len(d)
+}
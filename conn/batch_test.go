@@ -0,0 +1,50 @@
+package conn
+
+import (
+	"testing"
+
+	"github.com/butlermatt/dslink"
+)
+
+func TestBatchCoalesce(t *testing.T) {
+	b := newBatch(func(sid int32) uint8 {
+		if sid == 2 {
+			return 1
+		}
+		return 0
+	})
+
+	for i := 0; i < 3; i++ {
+		r := dslink.NewResp(0)
+		r.AddUpdate(int32(1), dslink.NewValueUpdate(i))
+		r.AddUpdate(int32(2), dslink.NewValueUpdate(i))
+		b.addResponse(r)
+	}
+	b.addResponse(dslink.NewResp(5))
+	b.addRequest(dslink.NewReq(1, dslink.MethodList))
+
+	m := b.message()
+	if !b.empty() {
+		t.Error("batch is not empty after message()")
+	}
+	if len(m.Resp) != 2 || len(m.Reqs) != 1 {
+		t.Fatalf("message() == %v, want 2 responses and 1 request", m)
+	}
+
+	var qos0, qos1 []interface{}
+	for _, u := range m.Resp[0].Updates {
+		mu := u.(map[string]interface{})
+		switch mu["sid"] {
+		case int32(1):
+			qos0 = append(qos0, mu["value"])
+		case int32(2):
+			qos1 = append(qos1, mu["value"])
+		}
+	}
+	if len(qos0) != 1 || qos0[0] != 2 {
+		t.Errorf("QoS 0 updates == %v, want [2]", qos0)
+	}
+	if len(qos1) != 3 {
+		t.Errorf("QoS 1 updates == %v, want 3 updates", qos1)
+	}
+}
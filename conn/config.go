@@ -0,0 +1,76 @@
+package conn
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/butlermatt/dslink/log"
+)
+
+// Config holds the settings of a link which are otherwise given by its command
+// line flags, for host programs which configure the link themselves. Settings
+// left at their zero value are taken from dslink.json, the environment or the
+// defaults. See NewLinkFromConfig.
+type Config struct {
+	// Name is the name of the link, or its prefix if it ends with a hyphen (-).
+	Name string
+	// Brokers lists the URLs of the brokers, tried as specified by Failover.
+	Brokers  []string
+	Failover Failover
+	Home     string
+	Token    string
+	// BasePath is the directory containing dslink.json. Relative paths are
+	// resolved against it.
+	BasePath  string
+	KeyPath   string
+	NodesPath string
+	LogFile   string
+	// LogLevel is one of debug, info, warn, error or disable.
+	LogLevel string
+}
+
+// NewLinkFromConfig creates a new Link configured by cfg instead of command
+// line flags, which are not parsed. The options are applied after cfg, so
+// they take precedence.
+func NewLinkFromConfig(cfg Config, options ...func(*config)) *Link {
+	opts := append([]func(*config){NoFlags}, cfg.options()...)
+	return NewLink(cfg.Name, append(opts, options...)...)
+}
+
+// options returns the options for NewLink setting the fields of cfg which are
+// not zero.
+func (cfg Config) options() []func(*config) {
+	var opts []func(*config)
+	if len(cfg.Brokers) > 0 {
+		opts = append(opts, Brokers(cfg.Brokers...))
+	}
+	if cfg.Failover != FailoverPriority {
+		opts = append(opts, BrokerFailover(cfg.Failover))
+	}
+	if cfg.Home != "" {
+		opts = append(opts, Home(cfg.Home))
+	}
+	if cfg.Token != "" {
+		opts = append(opts, Token(cfg.Token))
+	}
+	if cfg.BasePath != "" {
+		opts = append(opts, BasePath(cfg.BasePath))
+	}
+	if cfg.KeyPath != "" {
+		opts = append(opts, KeyPath(cfg.KeyPath))
+	}
+	if cfg.NodesPath != "" {
+		opts = append(opts, NodesPath(cfg.NodesPath))
+	}
+	if cfg.LogFile != "" {
+		opts = append(opts, LogFile(cfg.LogFile))
+	}
+	if cfg.LogLevel != "" {
+		ll, err := log.ToLevel(cfg.LogLevel)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unknown log level: %q Logging is disabled\n", cfg.LogLevel)
+		}
+		opts = append(opts, LogLevel(ll))
+	}
+	return opts
+}
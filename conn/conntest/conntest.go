@@ -0,0 +1,521 @@
+// Package conntest provides a mock DSA broker for testing links.
+//
+// A Server answers the /conn handshake and accepts the websocket
+// connection of a conn.Link, verifying its authentication. Once a link is
+// connected, tests use the returned Conn to send requests to the link and
+// assert on its responses.
+package conntest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/butlermatt/dslink"
+	"github.com/butlermatt/dslink/crypto"
+	"github.com/gorilla/websocket"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// ErrClosed is returned when the Server or Conn has been closed.
+var ErrClosed = errors.New("conntest: closed")
+
+// handshake is the body of a link's /conn request.
+type handshake struct {
+	PublicKey   string                 `json:"publicKey"`
+	IsRequester bool                   `json:"isRequester"`
+	IsResponder bool                   `json:"isResponder"`
+	LinkData    map[string]interface{} `json:"linkData"`
+	Version     string                 `json:"version"`
+	Formats     []string               `json:"formats"`
+	Compression bool                   `json:"enableWebSocketCompression"`
+}
+
+// session holds the handshake state of a link between its /conn request
+// and its websocket connections.
+type session struct {
+	hs      handshake
+	pub     crypto.PublicKey
+	tempKey crypto.PrivateKey
+	salt    string
+	format  string
+}
+
+// Server is a mock broker. Links connect to the URL of the Server and are
+// returned by Accept.
+type Server struct {
+	// URL is the handshake URL links should use as their broker.
+	URL string
+	// Formats lists the message formats the server accepts, in order of
+	// preference. It defaults to msgpack then json.
+	Formats []string
+
+	srv      *httptest.Server
+	ecdh     crypto.ECDH
+	upgrader websocket.Upgrader
+	mu       sync.Mutex
+	sessions map[string]*session
+	conns    chan *Conn
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewServer starts and returns a new Server. The caller should call Close
+// when finished to shut it down.
+func NewServer() *Server {
+	s := &Server{
+		Formats:  []string{"msgpack", "json"},
+		ecdh:     crypto.NewECDH(),
+		upgrader: websocket.Upgrader{EnableCompression: true},
+		sessions: make(map[string]*session),
+		conns:    make(chan *Conn),
+		done:     make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/conn", s.handleConn)
+	mux.HandleFunc("/ws", s.handleWs)
+	s.srv = httptest.NewServer(mux)
+	s.URL = s.srv.URL + "/conn"
+	return s
+}
+
+// Accept blocks until a link has connected to the server and returns its
+// connection.
+func (s *Server) Accept(ctx context.Context) (*Conn, error) {
+	select {
+	case c := <-s.conns:
+		return c, nil
+	case <-s.done:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close shuts down the server and blocks until all outstanding requests
+// on it have completed.
+func (s *Server) Close() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	s.srv.CloseClientConnections()
+	s.srv.Close()
+}
+
+func (s *Server) handleConn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dsId := r.URL.Query().Get("dsId")
+	var hs handshake
+	if err := json.NewDecoder(r.Body).Decode(&hs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pub, err := s.ecdh.UnmarshalPublic(hs.PublicKey)
+	if err != nil || !pub.VerifyDsId(dsId) {
+		http.Error(w, "invalid public key", http.StatusUnauthorized)
+		return
+	}
+
+	format := s.chooseFormat(hs.Formats)
+	if format == "" {
+		http.Error(w, "no supported format", http.StatusBadRequest)
+		return
+	}
+
+	tempKey, err := s.ecdh.GenerateKey(rand.Reader)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sess := &session{hs: hs, pub: pub, tempKey: tempKey, salt: newSalt(), format: format}
+	s.mu.Lock()
+	s.sessions[dsId] = sess
+	s.mu.Unlock()
+
+	name := strings.TrimSuffix(strings.TrimSuffix(dsId, pub.Hash64()), "-")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":        "conntest-broker",
+		"publicKey": tempKey.PublicKey.Base64(),
+		"wsUri":     "/ws",
+		"version":   "1.1.2",
+		"tempKey":   tempKey.PublicKey.Base64(),
+		"salt":      sess.salt,
+		"path":      "/downstream/" + name,
+		"format":    format,
+	})
+}
+
+func (s *Server) chooseFormat(formats []string) string {
+	for _, f := range s.Formats {
+		for _, lf := range formats {
+			if f == lf {
+				return f
+			}
+		}
+	}
+	return ""
+}
+
+func (s *Server) handleWs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	dsId := q.Get("dsId")
+
+	s.mu.Lock()
+	sess := s.sessions[dsId]
+	s.mu.Unlock()
+	if sess == nil {
+		http.Error(w, "unknown dsId", http.StatusUnauthorized)
+		return
+	}
+
+	shared := s.ecdh.GenerateSharedSecret(sess.tempKey, sess.pub)
+	s.mu.Lock()
+	want := s.ecdh.HashSalt(sess.salt, shared)
+	s.mu.Unlock()
+	if q.Get("auth") != want {
+		http.Error(w, "invalid auth", http.StatusUnauthorized)
+		return
+	}
+	if f := q.Get("format"); f != sess.format {
+		http.Error(w, "unexpected format "+f, http.StatusBadRequest)
+		return
+	}
+
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	// Issue a new salt which the link must use when it reconnects.
+	s.mu.Lock()
+	sess.salt = newSalt()
+	salt := sess.salt
+	s.mu.Unlock()
+
+	c := newConn(ws, dsId, sess)
+	if err = c.send(&dslink.Message{Salt: salt}); err != nil {
+		c.Close()
+		return
+	}
+	go c.read()
+
+	select {
+	case s.conns <- c:
+	case <-s.done:
+		c.Close()
+	}
+}
+
+func newSalt() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Conn is the broker side of a connected link.
+type Conn struct {
+	// DsId is the dsId the link connected with.
+	DsId string
+	// Format is the message format negotiated with the link.
+	Format string
+	// IsRequester reports whether the link declared requester support.
+	IsRequester bool
+	// IsResponder reports whether the link declared responder support.
+	IsResponder bool
+	// LinkData is the linkData sent by the link in its handshake.
+	LinkData map[string]interface{}
+	// Version is the protocol version sent by the link in its handshake.
+	Version string
+	// Compression reports whether the link asked for websocket compression.
+	Compression bool
+
+	ws     *websocket.Conn
+	wMu    sync.Mutex
+	msgId  int32
+	rMu    sync.Mutex
+	rid    int32
+	mu     sync.Mutex
+	resps  map[int32][]*dslink.Response
+	reqs   []*dslink.Request
+	notify chan struct{}
+	done   chan struct{}
+	err    error
+}
+
+func newConn(ws *websocket.Conn, dsId string, sess *session) *Conn {
+	return &Conn{
+		DsId:        dsId,
+		Format:      sess.format,
+		IsRequester: sess.hs.IsRequester,
+		IsResponder: sess.hs.IsResponder,
+		LinkData:    sess.hs.LinkData,
+		Version:     sess.hs.Version,
+		Compression: sess.hs.Compression,
+		ws:          ws,
+		resps:       make(map[int32][]*dslink.Response),
+		notify:      make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Close closes the connection to the link. A link will normally try to
+// reconnect afterwards.
+func (c *Conn) Close() error {
+	return c.ws.Close()
+}
+
+// Err returns the error which closed the connection, or nil if it is
+// still open.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Conn) send(m *dslink.Message) error {
+	c.wMu.Lock()
+	defer c.wMu.Unlock()
+
+	c.msgId++
+	m.Msg = c.msgId
+
+	var t int
+	var d []byte
+	var err error
+	if c.Format == "json" {
+		t = websocket.TextMessage
+		d, err = json.Marshal(m)
+	} else {
+		t = websocket.BinaryMessage
+		d, err = msgpack.Marshal(m)
+	}
+	if err != nil {
+		return err
+	}
+	return c.ws.WriteMessage(t, d)
+}
+
+func (c *Conn) read() {
+	var err error
+	for {
+		var p []byte
+		_, p, err = c.ws.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		m := &dslink.Message{}
+		if c.Format == "json" {
+			err = json.Unmarshal(p, m)
+		} else {
+			err = msgpack.Unmarshal(p, m)
+		}
+		if err != nil {
+			break
+		}
+
+		// Every numbered message is acked, including pings, so links with a
+		// send window do not stall.
+		if m.Msg > 0 {
+			if err = c.send(&dslink.Message{Ack: m.Msg}); err != nil {
+				break
+			}
+		}
+
+		c.mu.Lock()
+		for _, r := range m.Resp {
+			for i, u := range r.Updates {
+				r.Updates[i] = normalize(u)
+			}
+			c.resps[r.Rid] = append(c.resps[r.Rid], r)
+		}
+		for _, r := range m.Reqs {
+			r.Value = normalize(r.Value)
+		}
+		c.reqs = append(c.reqs, m.Reqs...)
+		close(c.notify)
+		c.notify = make(chan struct{})
+		c.mu.Unlock()
+	}
+
+	c.ws.Close()
+	c.mu.Lock()
+	c.err = err
+	close(c.done)
+	c.mu.Unlock()
+}
+
+// normalize converts the map[interface{}]interface{} values produced when
+// decoding msgpack to map[string]interface{}, so that tests can inspect
+// responses the same way regardless of the format in use.
+func normalize(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			ks, _ := k.(string)
+			m[ks] = normalize(e)
+		}
+		return m
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = normalize(e)
+		}
+		return t
+	case []interface{}:
+		for i, e := range t {
+			t[i] = normalize(e)
+		}
+		return t
+	default:
+		return v
+	}
+}
+
+// Send sends requests to the link. Requests without a rid are assigned
+// the next available rid. It returns the rid of the last request.
+func (c *Conn) Send(reqs ...*dslink.Request) (int32, error) {
+	var rid int32
+	c.rMu.Lock()
+	for _, r := range reqs {
+		if r.Rid == 0 {
+			c.rid++
+			r.Rid = c.rid
+		}
+		rid = r.Rid
+	}
+	c.rMu.Unlock()
+
+	return rid, c.send(&dslink.Message{Reqs: reqs})
+}
+
+// Next blocks until the link sends a response with the specified rid and
+// returns it. Responses are returned in the order they were received.
+// Subscription value updates use rid 0. Maps within updates are always
+// of type map[string]interface{}, whichever format is in use.
+func (c *Conn) Next(ctx context.Context, rid int32) (*dslink.Response, error) {
+	for {
+		c.mu.Lock()
+		if q := c.resps[rid]; len(q) > 0 {
+			r := q[0]
+			c.resps[rid] = q[1:]
+			c.mu.Unlock()
+			return r, nil
+		}
+		notify := c.notify
+		c.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-c.done:
+			c.mu.Lock()
+			pending := len(c.resps[rid]) > 0
+			c.mu.Unlock()
+			if !pending {
+				return nil, ErrClosed
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// NextRequest blocks until the link sends a request and returns it.
+func (c *Conn) NextRequest(ctx context.Context) (*dslink.Request, error) {
+	for {
+		c.mu.Lock()
+		if len(c.reqs) > 0 {
+			r := c.reqs[0]
+			c.reqs = c.reqs[1:]
+			c.mu.Unlock()
+			return r, nil
+		}
+		notify := c.notify
+		c.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-c.done:
+			return nil, ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Respond sends responses to the requests of a requester link.
+func (c *Conn) Respond(resps ...*dslink.Response) error {
+	return c.send(&dslink.Message{Resp: resps})
+}
+
+// Request sends req to the link and returns the first response to it.
+func (c *Conn) Request(ctx context.Context, req *dslink.Request) (*dslink.Response, error) {
+	rid, err := c.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	return c.Next(ctx, rid)
+}
+
+// List sends a list request for path and returns the first response.
+// The list stream stays open until CloseRequest is called with its rid.
+func (c *Conn) List(ctx context.Context, path string) (*dslink.Response, error) {
+	req := dslink.NewReq(0, dslink.MethodList)
+	req.Path = path
+	return c.Request(ctx, req)
+}
+
+// Subscribe subscribes to the value of path with the specified sid and
+// returns the response to the subscribe request. Value updates are
+// returned by calling Next with rid 0.
+func (c *Conn) Subscribe(ctx context.Context, path string, sid int32) (*dslink.Response, error) {
+	req := dslink.NewReq(0, dslink.MethodSub)
+	req.Paths = []*dslink.SubPath{{Path: path, Sid: sid}}
+	return c.Request(ctx, req)
+}
+
+// Unsubscribe removes the subscriptions with the specified sids.
+func (c *Conn) Unsubscribe(ctx context.Context, sids ...int32) (*dslink.Response, error) {
+	req := dslink.NewReq(0, dslink.MethodUnsub)
+	req.Sids = sids
+	return c.Request(ctx, req)
+}
+
+// Set sets the value of the node at path with the permit of the requester.
+func (c *Conn) Set(ctx context.Context, path string, value interface{}, permit dslink.PermType) (*dslink.Response, error) {
+	req := dslink.NewReq(0, dslink.MethodSet)
+	req.Path = path
+	req.Value = value
+	req.Permit = string(permit)
+	return c.Request(ctx, req)
+}
+
+// Invoke invokes the action at path and returns the first response. For
+// streaming results, further responses are returned by Next.
+func (c *Conn) Invoke(ctx context.Context, path string, params map[string]interface{}) (*dslink.Response, error) {
+	req := dslink.NewReq(0, dslink.MethodInvoke)
+	req.Path = path
+	req.Params = params
+	return c.Request(ctx, req)
+}
+
+// CloseRequest closes the stream of the request with the specified rid.
+func (c *Conn) CloseRequest(rid int32) error {
+	_, err := c.Send(dslink.NewReq(rid, dslink.MethodClose))
+	return err
+}
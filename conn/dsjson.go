@@ -0,0 +1,169 @@
+package conn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/butlermatt/dslink/log"
+)
+
+const (
+	defaultKeyPath   = ".dslink.key"
+	defaultNodesPath = "nodes.json"
+)
+
+// dsJson is the contents of the dslink.json file describing a link.
+type dsJson struct {
+	Name        string              `json:"name,omitempty"`
+	Version     string              `json:"version,omitempty"`
+	Description string              `json:"description,omitempty"`
+	Main        string              `json:"main,omitempty"`
+	Configs     map[string]dsConfig `json:"configs"`
+}
+
+// dsConfig is an entry of the configs in dslink.json. The value is used if
+// it is present, otherwise the default.
+type dsConfig struct {
+	Type        string      `json:"type,omitempty"`
+	Value       interface{} `json:"value,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+	Description string      `json:"description,omitempty"`
+}
+
+func (dc dsConfig) value() interface{} {
+	if dc.Value != nil {
+		return dc.Value
+	}
+	return dc.Default
+}
+
+// path resolves p relative to the base path of the link.
+func (c *config) path(p string) string {
+	if p == "" || c.rootPath == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(c.rootPath, p)
+}
+
+// loadDsJson applies the configs of the dslink.json file in the base path
+// to c. It returns false if the file does not exist, which the caller reports
+// once the log level is known.
+func loadDsJson(c *config) bool {
+	fn := c.path(dslinkJson)
+	d, err := ioutil.ReadFile(fn)
+	if err != nil && os.IsNotExist(err) {
+		return false
+	} else if err != nil {
+		log.Error.Printf("Unexpected error: %v", err)
+		return true
+	}
+
+	ds := &dsJson{}
+	err = json.Unmarshal(d, ds)
+	if err != nil {
+		log.Error.Printf("Unable to Unmarshal data: %s\nError:%v\n", d, err)
+		return true
+	}
+
+	for name, dc := range ds.Configs {
+		v := dc.value()
+		if v == nil {
+			continue
+		}
+		if err = applyDsConfig(c, name, v); err != nil {
+			log.Warn.Printf("Invalid config %q in %s: %v\n", name, fn, err)
+		}
+	}
+	return true
+}
+
+// applyDsConfig sets the configuration named name to the value v from
+// dslink.json. Unknown configs are ignored, as dslink.json may also hold
+// configs of the link itself.
+func applyDsConfig(c *config, name string, v interface{}) error {
+	if name == "broker" {
+		switch t := v.(type) {
+		case string:
+			c.brokers = splitBrokers(t)
+		case []interface{}:
+			c.brokers = nil
+			for _, a := range t {
+				s, ok := a.(string)
+				if !ok {
+					return fmt.Errorf("broker %v is not a string", a)
+				}
+				c.brokers = append(c.brokers, splitBrokers(s)...)
+			}
+		default:
+			return fmt.Errorf("expected a string or list, got %v", v)
+		}
+		return nil
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("expected a string, got %v", v)
+	}
+	switch name {
+	case "name":
+		c.name = s
+	case "failover":
+		f, err := parseFailover(s)
+		if err != nil {
+			return err
+		}
+		c.failover = f
+	case "log":
+		ll, err := log.ToLevel(s)
+		if err != nil {
+			return err
+		}
+		c.logLevel = ll
+	case "token":
+		c.token = s
+	case "home":
+		c.home = s
+	case "key":
+		c.keyPath = s
+	case "nodes":
+		c.nodesPath = s
+	}
+	return nil
+}
+
+// writeDsJson writes a default dslink.json for the configuration c to the
+// base path. The token is not written.
+func writeDsJson(c *config) error {
+	broker := brokerDefault
+	if len(c.brokers) > 0 {
+		broker = strings.Join(c.brokers, ",")
+	}
+	ll := strings.ToLower(c.logLevel.String())
+	if ll == "" {
+		ll = "disable"
+	}
+
+	ds := &dsJson{
+		Name:    strings.TrimSuffix(c.name, "-"),
+		Version: "0.0.1",
+		Configs: map[string]dsConfig{
+			"name":     {Type: "string", Value: c.name},
+			"broker":   {Type: "url", Value: broker},
+			"failover": {Type: "enum", Value: c.failover.String()},
+			"log":      {Type: "enum", Value: ll},
+			"token":    {Type: "string"},
+			"home":     {Type: "string", Value: c.home},
+			"key":      {Type: "path", Value: c.keyPath},
+			"nodes":    {Type: "path", Value: c.nodesPath},
+		},
+	}
+	d, err := json.MarshalIndent(ds, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path(dslinkJson), append(d, '\n'), 0644)
+}
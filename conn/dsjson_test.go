@@ -0,0 +1,105 @@
+package conn
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/butlermatt/dslink/log"
+)
+
+func TestDsJson(t *testing.T) {
+	dir := t.TempDir()
+	ds := `{
+  "name": "dslink-go-test",
+  "configs": {
+    "name": {"type": "string", "value": "JsonName-"},
+    "broker": {"type": "url", "value": "http://json/conn"},
+    "log": {"type": "enum", "value": "info"},
+    "home": {"type": "string", "default": "/home/json"},
+    "token": {"type": "string", "value": "jsonToken"},
+    "key": {"type": "path", "value": "keys/link.key"},
+    "nodes": {"type": "path", "value": "/var/lib/link/nodes.json"}
+  }
+}`
+	if err := ioutil.WriteFile(filepath.Join(dir, dslinkJson), []byte(ds), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// defaults < dslink.json < flags < options
+	l := NewLink("Test-", Args([]string{"--basepath", dir, "--broker", "http://flag/conn", "--token", "flagToken"}),
+		Token("optionToken"), LogLevel(log.ErrorLevel))
+
+	c := l.conf
+	if c.name != "JsonName-" {
+		t.Errorf("name == %q, want %q", c.name, "JsonName-")
+	}
+	if want := []string{"http://flag/conn"}; !reflect.DeepEqual(c.brokers, want) {
+		t.Errorf("brokers == %v, want %v", c.brokers, want)
+	}
+	if c.token != "optionToken" {
+		t.Errorf("token == %q, want %q", c.token, "optionToken")
+	}
+	if c.logLevel != log.ErrorLevel {
+		t.Errorf("logLevel == %v, want %v", c.logLevel, log.ErrorLevel)
+	}
+	if c.home != "/home/json" {
+		t.Errorf("home == %q, want %q", c.home, "/home/json")
+	}
+	if p := c.path(c.keyPath); p != filepath.Join(dir, "keys", "link.key") {
+		t.Errorf("key path == %q, want it in %s", p, dir)
+	}
+	if p := c.path(c.nodesPath); p != "/var/lib/link/nodes.json" {
+		t.Errorf("nodes path == %q, want %q", p, "/var/lib/link/nodes.json")
+	}
+}
+
+func TestDsJsonMissing(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+
+	// The missing file is only reported at the log level of the link.
+	NewLink("Test-", NoFlags, BasePath(t.TempDir()), LogLevel(log.DisabledLevel))
+	if buf.Len() != 0 {
+		t.Errorf("Link with logging disabled logged %q", buf.String())
+	}
+
+	log.SetOutput(&buf)
+	defer log.SetLevel(log.DisabledLevel)
+	NewLink("Test-", NoFlags, BasePath(t.TempDir()), LogLevel(log.WarningLevel))
+	if !strings.Contains(buf.String(), "Unable to find file") {
+		t.Errorf("Link logged %q, want the missing %s reported", buf.String(), dslinkJson)
+	}
+}
+
+func TestWriteDsJson(t *testing.T) {
+	dir := t.TempDir()
+	NewLink("Written-", NoFlags, BasePath(dir), Brokers("http://a/conn", "http://b/conn"), Token("secret"), WriteDsJson)
+
+	d, err := ioutil.ReadFile(filepath.Join(dir, dslinkJson))
+	if err != nil {
+		t.Fatalf("dslink.json was not written: %v", err)
+	}
+	if len(d) == 0 {
+		t.Fatal("dslink.json is empty")
+	}
+
+	l := NewLink("Other-", NoFlags, BasePath(dir))
+	if l.conf.name != "Written-" {
+		t.Errorf("name == %q, want %q", l.conf.name, "Written-")
+	}
+	if want := []string{"http://a/conn", "http://b/conn"}; !reflect.DeepEqual(l.conf.brokers, want) {
+		t.Errorf("brokers == %v, want %v", l.conf.brokers, want)
+	}
+	if l.conf.token != "" {
+		t.Errorf("token == %q, want it not to be written", l.conf.token)
+	}
+	if l.conf.keyPath != defaultKeyPath {
+		t.Errorf("keyPath == %q, want %q", l.conf.keyPath, defaultKeyPath)
+	}
+}
@@ -0,0 +1,114 @@
+package conn
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// EnvPrefix is the prefix of the environment variables configuring a link.
+// The variables are:
+//
+//	DSLINK_BROKER    Broker URL, or comma separated URLs of failover brokers
+//	DSLINK_FAILOVER  Broker failover strategy: priority, round-robin or random
+//	DSLINK_NAME      Link name
+//	DSLINK_TOKEN     Authorization token
+//	DSLINK_HOME      User home space to connect to
+//	DSLINK_BASEPATH  Root path of the link, containing dslink.json
+//	DSLINK_LOG       Log level: debug, info, warn, error or disable
+//	DSLINK_LOGFILE   Output file for the logger
+//	DSLINK_KEY       File containing the link's key pair
+//
+// Environment variables take precedence over dslink.json, but command line
+// flags and the options passed to NewLink take precedence over them.
+const EnvPrefix = "DSLINK_"
+
+// NoEnv is an option for NewLink. It stops the link from reading its
+// configuration from the DSLINK_ environment variables.
+func NoEnv(c *config) {
+	c.noEnv = true
+}
+
+// envFlags reads the link's environment variables. It returns nil if the
+// NoEnv option was given.
+func envFlags(c *config) *flags {
+	if c.noEnv {
+		return nil
+	}
+
+	var f flags
+	if v := os.Getenv(EnvPrefix + "BROKER"); v != "" {
+		f.brokers.Set(v)
+	}
+	f.failover = os.Getenv(EnvPrefix + "FAILOVER")
+	f.name = os.Getenv(EnvPrefix + "NAME")
+	f.token = os.Getenv(EnvPrefix + "TOKEN")
+	f.home = os.Getenv(EnvPrefix + "HOME")
+	f.basePath = os.Getenv(EnvPrefix + "BASEPATH")
+	f.logLevel = os.Getenv(EnvPrefix + "LOG")
+	f.logFile = os.Getenv(EnvPrefix + "LOGFILE")
+	f.keyPath = os.Getenv(EnvPrefix + "KEY")
+	return &f
+}
+
+// settingNames lists the settings of a config in the order they are dumped.
+var settingNames = []string{"broker", "failover", "name", "token", "home", "basepath", "log", "logfile", "key", "nodes"}
+
+// settings returns the settings of c which can be configured from more
+// than one source.
+func (c *config) settings() map[string]string {
+	return map[string]string{
+		"broker":   strings.Join(c.brokers, ","),
+		"failover": c.failover.String(),
+		"name":     c.name,
+		"token":    c.token,
+		"home":     c.home,
+		"basepath": c.rootPath,
+		"log":      c.logLevel.String(),
+		"logfile":  c.logFile,
+		"key":      c.keyPath,
+		"nodes":    c.nodesPath,
+	}
+}
+
+// track records src as the source of each setting of c which has changed
+// since prev, and updates prev to the current settings.
+func (c *config) track(src string, prev map[string]string) {
+	if c.sources == nil {
+		c.sources = make(map[string]string)
+	}
+	for k, v := range c.settings() {
+		if _, ok := c.sources[k]; !ok || v != prev[k] {
+			c.sources[k] = src
+		}
+		prev[k] = v
+	}
+}
+
+// DumpConfig writes the effective configuration of the link to w, along
+// with the source of each setting: default, dslink.json, env, flag or
+// option. Paths are shown resolved against the base path. The token itself
+// is not written.
+func (l *Link) DumpConfig(w io.Writer) error {
+	s := l.conf.settings()
+	if s["broker"] == "" {
+		s["broker"] = brokerDefault
+	}
+	if s["token"] != "" {
+		s["token"] = "(set)"
+	}
+	if s["log"] == "" {
+		s["log"] = "DISABLED"
+	}
+	for _, k := range []string{"logfile", "key", "nodes"} {
+		s[k] = l.conf.path(s[k])
+	}
+
+	for _, k := range settingNames {
+		if _, err := fmt.Fprintf(w, "%-8s = %s (%s)\n", k, s[k], l.conf.sources[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package conn
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnv(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(EnvPrefix+"BROKER", "http://env1/conn,http://env2/conn")
+	t.Setenv(EnvPrefix+"NAME", "EnvName-")
+	t.Setenv(EnvPrefix+"TOKEN", "envToken")
+	t.Setenv(EnvPrefix+"BASEPATH", dir)
+	t.Setenv(EnvPrefix+"LOG", "disable")
+	t.Setenv(EnvPrefix+"KEY", "env.key")
+
+	l := NewLink("Test-", Args([]string{"--name", "FlagName-"}), Home("/home/option"))
+	c := l.conf
+	if want := []string{"http://env1/conn", "http://env2/conn"}; !reflect.DeepEqual(c.brokers, want) {
+		t.Errorf("brokers == %v, want %v", c.brokers, want)
+	}
+	if c.name != "FlagName-" {
+		t.Errorf("name == %q, want the flag to take precedence", c.name)
+	}
+	if c.token != "envToken" {
+		t.Errorf("token == %q, want %q", c.token, "envToken")
+	}
+	if p := c.path(c.keyPath); p != filepath.Join(dir, "env.key") {
+		t.Errorf("key path == %q, want %q", p, filepath.Join(dir, "env.key"))
+	}
+
+	var b bytes.Buffer
+	if err := l.DumpConfig(&b); err != nil {
+		t.Fatalf("DumpConfig returned error: %v", err)
+	}
+	dump := b.String()
+	for _, want := range []string{
+		"broker   = http://env1/conn,http://env2/conn (env)",
+		"name     = FlagName- (flag)",
+		"token    = (set) (env)",
+		"home     = /home/option (option)",
+		"basepath = " + dir + " (env)",
+		"nodes    = " + filepath.Join(dir, defaultNodesPath) + " (default)",
+	} {
+		if !strings.Contains(dump, want+"\n") {
+			t.Errorf("DumpConfig() ==\n%s\nwant line %q", dump, want)
+		}
+	}
+	if strings.Contains(dump, "envToken") {
+		t.Errorf("DumpConfig() ==\n%s\nwant the token hidden", dump)
+	}
+
+	l = NewLink("Test-", NoFlags, NoEnv)
+	if l.conf.token != "" || len(l.conf.brokers) != 0 {
+		t.Errorf("Link with NoEnv read token %q and brokers %v", l.conf.token, l.conf.brokers)
+	}
+}
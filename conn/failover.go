@@ -0,0 +1,151 @@
+package conn
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/butlermatt/dslink/log"
+)
+
+// Failover selects the order in which a Link tries its brokers when it
+// connects and reconnects.
+type Failover int
+
+const (
+	// FailoverPriority tries the brokers in the order they were given and
+	// always starts with the first, so the Link returns to the preferred
+	// broker whenever it reconnects.
+	FailoverPriority Failover = iota
+	// FailoverRoundRobin moves on to the next broker each time a connection
+	// fails or is lost, wrapping around at the end of the list.
+	FailoverRoundRobin
+	// FailoverRandom tries the brokers in a random order.
+	FailoverRandom
+)
+
+func (f Failover) String() string {
+	switch f {
+	case FailoverPriority:
+		return "priority"
+	case FailoverRoundRobin:
+		return "round-robin"
+	case FailoverRandom:
+		return "random"
+	default:
+		return "unknown"
+	}
+}
+
+// parseFailover returns the Failover strategy named s.
+func parseFailover(s string) (Failover, error) {
+	switch strings.ToLower(s) {
+	case "priority":
+		return FailoverPriority, nil
+	case "round-robin", "roundrobin":
+		return FailoverRoundRobin, nil
+	case "random":
+		return FailoverRandom, nil
+	default:
+		return FailoverPriority, fmt.Errorf("Unknown failover strategy: %q", s)
+	}
+}
+
+// splitBrokers splits a comma separated list of broker URLs.
+func splitBrokers(v string) []string {
+	var addrs []string
+	for _, a := range strings.Split(v, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// failover dials a list of brokers. Each call to Dial tries every broker
+// once, in the order chosen by the strategy, until one of them connects.
+type failover struct {
+	addrs   []string
+	dialers []Dialer
+	mode    Failover
+	// next is the broker round robin starts with.
+	next int
+	// onDial is called before each broker is dialed with its address and
+	// the error of the previous attempt.
+	onDial func(addr string, err error)
+}
+
+// newFailover creates the failover dialer for the Link's brokers. A
+// TransportDialer replaces the brokers and is used on its own.
+func (l *Link) newFailover() (*failover, error) {
+	f := &failover{mode: l.conf.failover, onDial: l.dialing}
+	if l.conf.dialer != nil {
+		f.addrs = []string{""}
+		f.dialers = []Dialer{l.conf.dialer}
+		return f, nil
+	}
+
+	addrs := l.conf.brokers
+	if len(addrs) == 0 {
+		addrs = []string{brokerDefault}
+	}
+	// Invalid options are reported before a key is generated and saved.
+	if err := checkCompressionLevel(l.conf.compLevel); err != nil {
+		return nil, err
+	}
+	priv, err := loadKey(l.conf.path(l.conf.keyPath))
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		c, err := newHttpClient(&l.conf, addr, priv)
+		if err != nil {
+			return nil, fmt.Errorf("Broker %s: %v", addr, err)
+		}
+		f.addrs = append(f.addrs, addr)
+		f.dialers = append(f.dialers, c.Dial)
+	}
+	return f, nil
+}
+
+// order returns the indexes of the brokers in the order they are tried.
+func (f *failover) order() []int {
+	n := len(f.addrs)
+	if f.mode == FailoverRandom {
+		return rand.Perm(n)
+	}
+
+	start := 0
+	if f.mode == FailoverRoundRobin {
+		start = f.next
+	}
+	o := make([]int, n)
+	for i := range o {
+		o[i] = (start + i) % n
+	}
+	return o
+}
+
+// Dial connects to the first broker which accepts the connection. It
+// returns the error of the last broker tried if none of them do.
+func (f *failover) Dial(ctx context.Context) (Transport, error) {
+	var err error
+	for _, i := range f.order() {
+		f.onDial(f.addrs[i], err)
+		f.next = (i + 1) % len(f.addrs)
+
+		var t Transport
+		t, err = f.dialers[i](ctx)
+		if err == nil {
+			return t, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if len(f.addrs) > 1 {
+			log.Warn.Printf("Unable to connect to broker %s: %v\n", f.addrs[i], err)
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,119 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/butlermatt/dslink/conn/conntest"
+)
+
+func TestFailoverDial(t *testing.T) {
+	errDown := errors.New("broker down")
+	tests := []struct {
+		mode Failover
+		// up lists the brokers which accept connections on each Dial.
+		up   [][]bool
+		want [][]string
+	}{
+		{FailoverPriority, [][]bool{{false, true, true}, {true, true, true}},
+			[][]string{{"a", "b"}, {"a"}}},
+		{FailoverRoundRobin, [][]bool{{false, true, true}, {true, true, true}, {true, false, false}},
+			[][]string{{"a", "b"}, {"c"}, {"a"}}},
+		{FailoverPriority, [][]bool{{false, false, false}},
+			[][]string{{"a", "b", "c"}}},
+	}
+
+	for _, tc := range tests {
+		var tried []string
+		var up []bool
+		f := &failover{
+			addrs:  []string{"a", "b", "c"},
+			mode:   tc.mode,
+			onDial: func(addr string, err error) { tried = append(tried, addr) },
+		}
+		for i := range f.addrs {
+			i := i
+			f.dialers = append(f.dialers, func(ctx context.Context) (Transport, error) {
+				if !up[i] {
+					return nil, errDown
+				}
+				a, _ := Pipe()
+				return a, nil
+			})
+		}
+
+		for i := range tc.up {
+			tried = nil
+			up = tc.up[i]
+			_, err := f.Dial(context.Background())
+			if !reflect.DeepEqual(tried, tc.want[i]) {
+				t.Errorf("%v Dial %d tried %v, want %v", tc.mode, i, tried, tc.want[i])
+			}
+			down := true
+			for _, u := range up {
+				down = down && !u
+			}
+			if (err != nil) != down {
+				t.Errorf("%v Dial %d returned error %v", tc.mode, i, err)
+			}
+		}
+	}
+
+	f := &failover{addrs: []string{"a", "b", "c"}, mode: FailoverRandom}
+	o := f.order()
+	sort.Ints(o)
+	if !reflect.DeepEqual(o, []int{0, 1, 2}) {
+		t.Errorf("Random order == %v, want each broker once", o)
+	}
+}
+
+func TestParseBrokers(t *testing.T) {
+	var b brokerList
+	b.Set("http://a/conn, http://b/conn")
+	b.Set("http://c/conn")
+	want := brokerList{"http://a/conn", "http://b/conn", "http://c/conn"}
+	if !reflect.DeepEqual(b, want) {
+		t.Errorf("brokerList == %v, want %v", b, want)
+	}
+
+	if f, err := parseFailover("round-robin"); err != nil || f != FailoverRoundRobin {
+		t.Errorf("parseFailover(round-robin) == %v, %v, want %v", f, err, FailoverRoundRobin)
+	}
+	if _, err := parseFailover("fastest"); err == nil {
+		t.Error("parseFailover(fastest) did not return an error")
+	}
+}
+
+func TestLinkFailover(t *testing.T) {
+	down := httptest.NewServer(nil)
+	down.Close()
+	s := conntest.NewServer()
+	defer s.Close()
+
+	l := NewLink("Test-", NoFlags, Brokers(down.URL+"/conn", s.URL))
+	l.conf.keyPath = filepath.Join(t.TempDir(), ".dslink.key")
+	l.Init()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- l.Run(ctx)
+	}()
+
+	if _, err := s.Accept(ctx); err != nil {
+		t.Fatalf("Accept() returned error: %v", err)
+	}
+	if b := l.State().Broker; b != s.URL {
+		t.Errorf("State().Broker == %q, want %q", b, s.URL)
+	}
+
+	cancel()
+	<-errc
+}
@@ -5,26 +5,52 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"github.com/butlermatt/dslink/log"
 )
 
 const brokerDefault = "http://127.0.0.1:8080/conn"
 
-var (
-	brokerAddr string
-	linkName   string
-	home       string
-	token      string
-	basePath   string
-	logFile    string
-	logL       string
-	help       bool
-)
+// brokerList is a flag.Value collecting broker URLs from repeated flags and
+// comma separated values.
+type brokerList []string
+
+func (b *brokerList) String() string {
+	if b == nil {
+		return ""
+	}
+	return strings.Join(*b, ",")
+}
+
+func (b *brokerList) Set(v string) error {
+	*b = append(*b, splitBrokers(v)...)
+	return nil
+}
 
-func init() {
+// flags holds the values of the command line flags, or environment
+// variables, of a link.
+type flags struct {
+	brokers  brokerList
+	failover string
+	name     string
+	home     string
+	token    string
+	basePath string
+	logFile  string
+	logLevel string
+	// keyPath is only set from the environment.
+	keyPath string
+}
+
+// flagNames are the names of the link's flags, other than their shorthands.
+var flagNames = []string{"log", "broker", "failover", "name", "home", "token", "basepath", "logfile"}
+
+// register defines the link's flags on fs. Flags which are already defined,
+// such as by another link sharing fs, are left alone and read by read.
+func (f *flags) register(fs *flag.FlagSet) {
 	const (
-		helpUsage   = "Display this help message"
-		brokerUsage = "Broker `URL`"
+		brokerUsage = "Broker `URL`. Repeat the flag or separate URLs with commas to list failover brokers (default " + brokerDefault + ")"
+		failUsage   = "Broker failover `strategy`. Valid values are: priority, round-robin, random. Default is priority"
 		homeUsage   = "Connect to user `home` space"
 		nameUsage   = "Link `Name`"
 		tokenUsage  = "Authorization `Token`"
@@ -33,49 +59,153 @@ func init() {
 		loglUsage   = "Set the log level. Valid values are: debug, info, warn, error, disable. Default is disable"
 	)
 
-	flag.Usage = func() {
-		ex := filepath.Base(os.Args[0])
-		fmt.Fprintf(os.Stderr, "Usage of %s:\n", ex)
-		flag.PrintDefaults()
-	}
-
-	flag.BoolVar(&help, "h", false, helpUsage)
-	flag.BoolVar(&help, "help", false, helpUsage)
-	flag.StringVar(&logL, "log", "", loglUsage)
-	flag.StringVar(&brokerAddr, "broker", brokerDefault, brokerUsage)
-	flag.StringVar(&brokerAddr, "b", brokerDefault, brokerUsage)
-	flag.StringVar(&linkName, "name", "", nameUsage)
-	flag.StringVar(&linkName, "n", "", nameUsage)
-	flag.StringVar(&home, "home", "", homeUsage)
-	flag.StringVar(&token, "token", "", tokenUsage)
-	flag.StringVar(&basePath, "basepath", "", baseUsage)
-	flag.StringVar(&logFile, "logfile", "", logfUsage)
-}
+	define := func(v flag.Value, name, usage string) {
+		if fs.Lookup(name) == nil {
+			fs.Var(v, name, usage)
+		}
+	}
+	str := func(p *string, name, usage string) {
+		if fs.Lookup(name) == nil {
+			fs.StringVar(p, name, "", usage)
+		}
+	}
 
-func parseFlags(c *config) {
-	flag.Parse()
+	str(&f.logLevel, "log", loglUsage)
+	define(&f.brokers, "broker", brokerUsage)
+	define(&f.brokers, "b", brokerUsage)
+	str(&f.failover, "failover", failUsage)
+	str(&f.name, "name", nameUsage)
+	str(&f.name, "n", nameUsage)
+	str(&f.home, "home", homeUsage)
+	str(&f.token, "token", tokenUsage)
+	str(&f.basePath, "basepath", baseUsage)
+	str(&f.logFile, "logfile", logfUsage)
+}
 
-	if help {
-		flag.Usage()
-		os.Exit(0)
+// read copies the values of the link's flags from fs, which may be bound to
+// the flags of another link sharing fs.
+func (f *flags) read(fs *flag.FlagSet) {
+	vals := make(map[string]string)
+	for _, name := range flagNames {
+		if fl := fs.Lookup(name); fl != nil {
+			vals[name] = fl.Value.String()
+		}
+	}
+	f.logLevel = vals["log"]
+	f.brokers = nil
+	if vals["broker"] != "" {
+		f.brokers.Set(vals["broker"])
 	}
+	f.failover = vals["failover"]
+	f.name = vals["name"]
+	f.home = vals["home"]
+	f.token = vals["token"]
+	f.basePath = vals["basepath"]
+	f.logFile = vals["logfile"]
+}
 
-	if brokerAddr != brokerDefault || c.broker == "" {
-		c.broker = brokerAddr
+// apply copies the flags which were given to c. Flags take precedence over
+// dslink.json, but not over the options passed to NewLink.
+func (f *flags) apply(c *config) {
+	if len(f.brokers) > 0 {
+		c.brokers = f.brokers
 	}
-	if linkName != "" {
-		c.name = linkName
+	if f.failover != "" {
+		fo, err := parseFailover(f.failover)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v Using %v\n", err, c.failover)
+		} else {
+			c.failover = fo
+		}
 	}
-
-	c.home = home
-	c.token = token
-	c.rootPath = basePath
-	c.logFile = logFile
-	if logL != "" {
-		ll, err := log.ToLevel(logL)
+	if f.name != "" {
+		c.name = f.name
+	}
+	if f.home != "" {
+		c.home = f.home
+	}
+	if f.token != "" {
+		c.token = f.token
+	}
+	if f.basePath != "" {
+		c.rootPath = f.basePath
+	}
+	if f.logFile != "" {
+		c.logFile = f.logFile
+	}
+	if f.keyPath != "" {
+		c.keyPath = f.keyPath
+	}
+	if f.logLevel != "" {
+		ll, err := log.ToLevel(f.logLevel)
 		c.logLevel = ll
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unknown log level: %q Logging is disabled\n", logL)
+			fmt.Fprintf(os.Stderr, "Unknown log level: %q Logging is disabled\n", f.logLevel)
+		}
+	}
+}
+
+// parseFlags parses the link's command line flags as configured by the
+// NoFlags, FlagSet and Args options in c. It returns nil if flags are not
+// parsed. Unless the FlagSet option was given, the flags are defined on a
+// flag set of their own, and only the link's flags are parsed from the
+// arguments, so the host program's flags and -h are left to the host
+// program. A flag with an invalid value is reported and ignored.
+func parseFlags(c *config) *flags {
+	if c.noFlags {
+		return nil
+	}
+
+	args := c.args
+	if args == nil {
+		args = os.Args[1:]
+	}
+
+	var f flags
+	fs := c.flagSet
+	if fs == nil {
+		fs = flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+		f.register(fs)
+		args = linkArgs(fs, args)
+	} else {
+		f.register(fs)
+	}
+	if !fs.Parsed() {
+		if err := fs.Parse(args); err != nil {
+			// Only reached if fs continues on error, in which case it has
+			// already reported the error.
+			return nil
+		}
+	}
+	f.read(fs)
+	return &f
+}
+
+// linkArgs returns the flags in args which are defined on fs, along with
+// their values. Other arguments, and any following "--", are dropped.
+func linkArgs(fs *flag.FlagSet, args []string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			break
+		}
+		if !strings.HasPrefix(a, "-") || a == "-" {
+			continue
+		}
+		name := strings.TrimLeft(a, "-")
+		hasValue := strings.Contains(name, "=")
+		if hasValue {
+			name = name[:strings.Index(name, "=")]
+		}
+		if fs.Lookup(name) == nil {
+			continue
+		}
+		out = append(out, a)
+		if !hasValue && i+1 < len(args) {
+			i++
+			out = append(out, args[i])
 		}
 	}
+	return out
 }
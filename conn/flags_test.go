@@ -0,0 +1,87 @@
+package conn
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+
+	"github.com/butlermatt/dslink/log"
+)
+
+func TestFlags(t *testing.T) {
+	l := NewLink("Test-", Args([]string{"--broker", "http://a/conn,http://b/conn", "-b", "http://c/conn",
+		"--name", "Flagged-", "--failover", "random"}))
+	want := []string{"http://a/conn", "http://b/conn", "http://c/conn"}
+	if !reflect.DeepEqual(l.conf.brokers, want) {
+		t.Errorf("brokers == %v, want %v", l.conf.brokers, want)
+	}
+	if l.conf.name != "Flagged-" {
+		t.Errorf("name == %q, want %q", l.conf.name, "Flagged-")
+	}
+	if l.conf.failover != FailoverRandom {
+		t.Errorf("failover == %v, want %v", l.conf.failover, FailoverRandom)
+	}
+
+	// The host program's own flags are parsed along with the link's.
+	fs := flag.NewFlagSet("host", flag.ContinueOnError)
+	verbose := fs.Bool("verbose", false, "")
+	l = NewLink("Test-", Broker("http://option/conn"), FlagSet(fs),
+		Args([]string{"--verbose", "--home", "/home/test"}))
+	if !*verbose {
+		t.Error("Host flag --verbose was not parsed")
+	}
+	if l.conf.home != "/home/test" {
+		t.Errorf("home == %q, want %q", l.conf.home, "/home/test")
+	}
+	if want := []string{"http://option/conn"}; !reflect.DeepEqual(l.conf.brokers, want) {
+		t.Errorf("brokers == %v, want %v", l.conf.brokers, want)
+	}
+
+	// The host program's flags and -h are ignored by the link's own flag set.
+	l = NewLink("Test-", Args([]string{"-h", "--verbose", "--level", "3", "--name=Mixed-", "serve", "--home", "/h"}))
+	if l.conf.name != "Mixed-" {
+		t.Errorf("name among host flags == %q, want %q", l.conf.name, "Mixed-")
+	}
+	if l.conf.home != "/h" {
+		t.Errorf("home after a subcommand == %q, want %q", l.conf.home, "/h")
+	}
+
+	// Links may share a flag set, which is parsed once.
+	fs = flag.NewFlagSet("shared", flag.ContinueOnError)
+	args := Args([]string{"--name", "Shared-"})
+	l = NewLink("Test-", FlagSet(fs), args)
+	l2 := NewLink("Test-", FlagSet(fs), args)
+	if l.conf.name != "Shared-" || l2.conf.name != "Shared-" {
+		t.Errorf("names with a shared flag set == %q and %q, want %q", l.conf.name, l2.conf.name, "Shared-")
+	}
+
+	// Flags are ignored with NoFlags.
+	l = NewLink("Test-", NoFlags, Args([]string{"--name", "Flagged-"}))
+	if l.conf.name != "Test-" {
+		t.Errorf("name with NoFlags == %q, want %q", l.conf.name, "Test-")
+	}
+}
+
+func TestNewLinkFromConfig(t *testing.T) {
+	defer log.SetLevel(log.DisabledLevel)
+	l := NewLinkFromConfig(Config{Name: "Configured-", Brokers: []string{"http://a/conn"}, Failover: FailoverRandom,
+		LogLevel: "info"}, Home("/option"))
+	if l.conf.name != "Configured-" {
+		t.Errorf("name == %q, want %q", l.conf.name, "Configured-")
+	}
+	if want := []string{"http://a/conn"}; !reflect.DeepEqual(l.conf.brokers, want) {
+		t.Errorf("brokers == %v, want %v", l.conf.brokers, want)
+	}
+	if l.conf.failover != FailoverRandom {
+		t.Errorf("failover == %v, want %v", l.conf.failover, FailoverRandom)
+	}
+	if l.conf.logLevel != log.InfoLevel {
+		t.Errorf("logLevel == %v, want %v", l.conf.logLevel, log.InfoLevel)
+	}
+	if l.conf.home != "/option" {
+		t.Errorf("home == %q, want %q", l.conf.home, "/option")
+	}
+	if !l.conf.noFlags {
+		t.Error("NewLinkFromConfig parses flags")
+	}
+}
@@ -1,33 +1,39 @@
 package conn
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
 import (
-	"github.com/butlermatt/dslink"
-	"github.com/butlermatt/dslink/log"
 	"github.com/butlermatt/dslink/crypto"
+	"github.com/butlermatt/dslink/log"
 	"github.com/gorilla/websocket"
-	"gopkg.in/vmihailenco/msgpack.v2"
 )
 
-const pingTime = 30 * time.Second
-const maxMsgId = 0x7FFFFFFF
-
-type msgFormat int
-
-const (
-	fmtJson msgFormat = iota
-	fmtMsgP
-)
+const dsaVersion = "1.1.2"
+
+// dsReq is the body of the handshake request sent to the broker.
+type dsReq struct {
+	PublicKey   string                 `json:"publicKey"`
+	IsRequester bool                   `json:"isRequester"`
+	IsResponder bool                   `json:"isResponder"`
+	LinkData    map[string]interface{} `json:"linkData"`
+	Version     string                 `json:"version"`
+	Formats     []string               `json:"formats"`
+	Compression bool                   `json:"enableWebSocketCompression"`
+}
 
 type dsResp struct {
 	Id        string `json:"id"`
@@ -43,34 +49,67 @@ type dsResp struct {
 	Format    string `json:"format"`
 }
 
+// httpClient performs the http handshake with the broker and dials websocket
+// transports. It is kept for the lifetime of a Link so that reconnects can
+// reuse the previous handshake and the most recent salt.
 type httpClient struct {
-	dsId      string
-	msgId     int32
-	keyMaker  crypto.ECDH
-	htClient  *http.Client
-	rawUrl    *url.URL
-	home      string
-	token     string
-	tHash     string
-	wsClient  *websocket.Conn
-	cPriv     crypto.PrivateKey
-	in        chan []byte
-	out       chan *dslink.Message
-	ping      *time.Timer
-	msgs      chan *dslink.Message
-	format    msgFormat
-	responder bool
-	requester bool
+	dsId          string
+	keyMaker      crypto.ECDH
+	htClient      *http.Client
+	wsDialer      *websocket.Dialer
+	rawUrl        *url.URL
+	home          string
+	token         string
+	tHash         string
+	wsConf        *dsResp
+	sMu           sync.Mutex
+	salt          string
+	cPriv         crypto.PrivateKey
+	hsReq         dsReq
+	compLevel     int
+	compThreshold int
 }
 
-// Close will force the Websocket on the httpClient to be closed.
-func (c *httpClient) Close() {
-	if c.wsClient != nil {
-		_ = c.wsClient.Close()
+// Dial establishes a websocket transport with the broker. If a previous
+// handshake is available along with a reconnect salt received on an earlier
+// connection, the handshake is reused with that salt. Otherwise, or if that
+// fails, a full handshake is performed.
+func (c *httpClient) Dial(ctx context.Context) (Transport, error) {
+	c.sMu.Lock()
+	salt := c.salt
+	c.sMu.Unlock()
+
+	if c.wsConf != nil && salt != "" {
+		conf := *c.wsConf
+		conf.Salt = salt
+		t, err := c.connectWs(ctx, &conf)
+		if err == nil {
+			return t, nil
+		}
+		log.Warn.Printf("Unable to reconnect using previous handshake: %v\n", err)
+	}
+
+	ret, err := c.getWsConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.wsConf = ret
+
+	t, err := c.connectWs(ctx, ret)
+	if err != nil {
+		return nil, err
 	}
+	return t, nil
 }
 
-func (c *httpClient) getWsConfig() (*dsResp, error) {
+// setSalt stores the salt to use when reconnecting.
+func (c *httpClient) setSalt(salt string) {
+	c.sMu.Lock()
+	defer c.sMu.Unlock()
+	c.salt = salt
+}
+
+func (c *httpClient) getWsConfig(ctx context.Context) (*dsResp, error) {
 	u, _ := url.Parse(c.rawUrl.String())
 	q := u.Query()
 	q.Add("dsId", c.dsId)
@@ -82,11 +121,16 @@ func (c *httpClient) getWsConfig() (*dsResp, error) {
 	}
 	u.RawQuery = q.Encode()
 
-	// TODO: Put this in a struct!
-	values := fmt.Sprintf("{\"publicKey\": \"%s\", \"isRequester\": %t, \"isResponder\": %t,"+
-		"\"linkData\": {}, \"version\": \"1.1.2\", \"formats\": [\"msgpack\",\"json\"], \"enableWebSocketCompression\": true}",
-		c.cPriv.PublicKey.Base64(), c.requester, c.responder)
-	res, err := c.htClient.Post(u.String(), "application/json", strings.NewReader(values))
+	values, err := json.Marshal(c.hsReq)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to encode handshake: %s", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(values))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.htClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, fmt.Errorf("Error connecting to address: \"%s\"\nError: %s", c.rawUrl, err)
 	}
@@ -105,12 +149,13 @@ func (c *httpClient) getWsConfig() (*dsResp, error) {
 	return dr, nil
 }
 
-func (c *httpClient) connectWs(config *dsResp) (*websocket.Conn, error) {
+func (c *httpClient) connectWs(ctx context.Context, config *dsResp) (*wsConn, error) {
+	var format msgFormat
 	switch config.Format {
 	case "json":
-		c.format = fmtJson
+		format = fmtJson
 	case "msgpack":
-		c.format = fmtMsgP
+		format = fmtMsgP
 	default:
 		return nil, fmt.Errorf("Unknown message format: %s", config.Format)
 	}
@@ -139,145 +184,155 @@ func (c *httpClient) connectWs(config *dsResp) (*websocket.Conn, error) {
 		q.Add("token", c.token+c.tHash)
 	}
 	u.RawQuery = q.Encode()
-	u.Scheme = "ws"
+	u.Scheme = wsScheme(u.Scheme)
 
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	conn, res, err := c.wsDialer.DialContext(ctx, u.String(), nil)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to connect to Websocket at: %s\nError: %s", u.String(), err)
 	}
 
-	return conn, nil
+	ws := &wsConn{client: c, conn: conn, format: format}
+	if strings.Contains(res.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+		ws.compressed = true
+		ws.threshold = c.compThreshold
+		if err = conn.SetCompressionLevel(c.compLevel); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	log.Printf("Connected to Websocket. Compression enabled: %t\n", ws.compressed)
+
+	return ws, nil
 }
 
-func (c *httpClient) marshal(v interface{}) (int, []byte, error) {
-	var f int
-	var d []byte
-	var err error
-	switch c.format {
-	case fmtJson:
-		f = websocket.TextMessage
-		d, err = json.Marshal(v)
-	case fmtMsgP:
-		f = websocket.BinaryMessage
-		d, err = msgpack.Marshal(v)
+// wsScheme returns the websocket scheme matching the scheme of the broker URL.
+// Secure (https) brokers use secure websockets (wss).
+func wsScheme(scheme string) string {
+	switch strings.ToLower(scheme) {
+	case "https", "wss":
+		return "wss"
+	default:
+		return "ws"
+	}
+}
+
+// proxyFunc returns the function selecting the proxy used for the handshake
+// and websocket requests. Unless a proxy is configured explicitly, it is
+// taken from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+// Credentials in the proxy URL are sent using basic authentication.
+func proxyFunc(conf *config) (func(*http.Request) (*url.URL, error), error) {
+	if !conf.proxySet {
+		return http.ProxyFromEnvironment, nil
+	}
+	if conf.proxy == "" {
+		return nil, nil
 	}
 
-	return f, d, err
+	u, err := url.Parse(conf.proxy)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("Invalid proxy URL: %s", conf.proxy)
+	}
+	return http.ProxyURL(u), nil
 }
 
-func (c *httpClient) unmarshal(data []byte, v interface{}) error {
-	var err error
-	switch c.format {
-	case fmtJson:
-		err = json.Unmarshal(data, v)
-	case fmtMsgP:
-		err = msgpack.Unmarshal(data, v)
+// loadKey loads the link's key pair from path. If it cannot be loaded, a new
+// key pair is generated and saved to path.
+func loadKey(path string) (crypto.PrivateKey, error) {
+	priv, err := crypto.LoadKey(path)
+	if err == nil {
+		return priv, nil
+	}
+	priv, err = crypto.NewECDH().GenerateKey(rand.Reader)
+	if err != nil {
+		return priv, fmt.Errorf("Unable to generate key: %v", err)
 	}
-	return err
+	_ = crypto.SaveKey(priv, path)
+	return priv, nil
 }
 
-func (c *httpClient) handleConnections() {
-	go func() {
-		for {
-			_, p, err := c.wsClient.ReadMessage()
-			if err != nil {
-				//TODO: Better logging/handling here
-				log.Error.Printf("Read error! %v\n", err)
-				return
-			}
-			c.in <- p
-		}
-	}()
-
-	c.wsClient.WriteMessage(websocket.TextMessage, []byte("{}"))
-	for {
-		select {
-		case s := <-c.in:
-			msg := &dslink.Message{Msg: -1, Ack: -1}
-			err := c.unmarshal(s, msg)
-			if err != nil {
-				log.Error.Printf("Error unmarshalling %s\nError: %v\n", s, err)
-			}
-			log.Printf("Recv: %v", msg)
-			c.msgs <- msg
-		case m := <-c.out:
-			if c.msgId == maxMsgId {
-				c.msgId = 0
-			}
-			c.msgId++
-			m.Msg = c.msgId
-			t, s, err := c.marshal(*m)
-			if err != nil {
-				log.Error.Printf("Error marshalling %+v\nError: %+v\n", *m, err)
-				continue
-			}
-			log.Printf("Sent: %v\n", m)
-			c.wsClient.WriteMessage(t, s)
-			if !c.ping.Stop() {
-				<-c.ping.C
-			}
-			c.ping.Reset(pingTime)
-		case <-c.ping.C:
-			go func() {
-				m := &dslink.Message{Msg: c.msgId}
-				c.out <- m
-			}()
-			c.ping.Reset(pingTime)
-		}
+// checkCompressionLevel returns an error if level is not a valid flate compression level.
+func checkCompressionLevel(level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return fmt.Errorf("Invalid compression level: %d", level)
 	}
+	return nil
 }
 
-// Dial will attempt to connect a Link with the specified prefix to the specified address.
-// Returns an error if connection handshake fails. Otherwise returns the connected httpClient.
-func dial(conf *config, msgs chan *dslink.Message) (*httpClient, error) {
-	u, err := url.Parse(conf.broker)
+// newHttpClient creates an httpClient for the broker at addr, identified by the
+// key pair priv. It does not connect to the broker. Call Dial to establish a connection.
+func newHttpClient(conf *config, addr string, priv crypto.PrivateKey) (*httpClient, error) {
+	if err := checkCompressionLevel(conf.compLevel); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	c := &httpClient{
-		keyMaker:  crypto.NewECDH(),
-		htClient:  &http.Client{Timeout: time.Second * 60},
-		rawUrl:    u,
-		home:      conf.home,
-		msgs:      msgs,
-		responder: conf.isResponder,
-		requester: conf.isRequester,
-	}
-
-	// TODO: The keys should be managed outside of the httpClient and
-	// passed in as needed
-	c.cPriv, err = crypto.LoadKey(conf.keyPath)
+	var tlsConf *tls.Config
+	if conf.tlsConfig != nil {
+		tlsConf = conf.tlsConfig.Clone()
+	}
+	proxy, err := proxyFunc(conf)
 	if err != nil {
-		c.cPriv, err = c.keyMaker.GenerateKey(rand.Reader)
-		if err != nil {
-			return nil, fmt.Errorf("Unable to generate key: %v", err)
-		}
-		_ = crypto.SaveKey(c.cPriv, conf.keyPath)
+		return nil, err
 	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConf
+	tr.Proxy = proxy
+
+	c := &httpClient{
+		keyMaker: crypto.NewECDH(),
+		htClient: &http.Client{Timeout: time.Second * 60, Transport: tr},
+		wsDialer: &websocket.Dialer{
+			Proxy:             proxy,
+			HandshakeTimeout:  websocket.DefaultDialer.HandshakeTimeout,
+			TLSClientConfig:   tlsConf,
+			EnableCompression: conf.compression,
+		},
+		rawUrl:        u,
+		home:          conf.home,
+		cPriv:         priv,
+		compLevel:     conf.compLevel,
+		compThreshold: conf.compThresh,
+	}
+
 	c.dsId = c.cPriv.DsId(conf.name)
 
-	if len(conf.token) >= 16 { // TODO: Why 16??
-		c.token = conf.token[:16]
-		c.tHash = c.keyMaker.HashToken(c.dsId, c.token)
+	formats := conf.formats
+	if len(formats) == 0 {
+		formats = []string{"msgpack", "json"}
+	}
+	for _, f := range formats {
+		if f != "msgpack" && f != "json" {
+			return nil, fmt.Errorf("Unknown message format: %s", f)
+		}
 	}
 
-	ret, err := c.getWsConfig()
-	if err != nil {
-		return nil, err
+	linkData := conf.linkData
+	if linkData == nil {
+		linkData = make(map[string]interface{})
 	}
 
-	conn, err := c.connectWs(ret)
-	if err != nil {
-		return nil, err
+	version := conf.version
+	if version == "" {
+		version = dsaVersion
 	}
 
-	c.wsClient = conn
-	c.ping = time.NewTimer(pingTime)
-	c.in = make(chan []byte)
-	c.out = make(chan *dslink.Message)
+	c.hsReq = dsReq{
+		PublicKey:   c.cPriv.PublicKey.Base64(),
+		IsRequester: conf.isRequester,
+		IsResponder: conf.isResponder,
+		LinkData:    linkData,
+		Version:     version,
+		Formats:     formats,
+		Compression: conf.compression,
+	}
 
-	go c.handleConnections()
+	if len(conf.token) >= 16 { // TODO: Why 16??
+		c.token = conf.token[:16]
+		c.tHash = c.keyMaker.HashToken(c.dsId, c.token)
+	}
 
 	return c, nil
 }
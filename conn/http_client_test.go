@@ -1,17 +1,353 @@
 package conn
 
 import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/butlermatt/dslink"
+	"github.com/butlermatt/dslink/conn/conntest"
 )
 
+// newTestClient creates an httpClient for the first broker of conf.
+func newTestClient(conf *config) (*httpClient, error) {
+	priv, err := loadKey(conf.keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return newHttpClient(conf, conf.brokers[0], priv)
+}
+
 func TestDial(t *testing.T) {
-	c, err := dial("http://localhost:8080/conn", "myTest-", "", "")
+	for _, format := range []string{"json", "msgpack"} {
+		s := conntest.NewServer()
+		s.Formats = []string{format}
+
+		conf := &config{
+			brokers:     []string{s.URL},
+			name:        "myTest-",
+			keyPath:     filepath.Join(t.TempDir(), ".dslink.key"),
+			isResponder: true,
+		}
+		c, err := newTestClient(conf)
+		if err != nil {
+			t.Fatalf("Unable to create client: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		tr, err := c.Dial(ctx)
+		if err != nil {
+			t.Fatalf("Dial failed with format %s: %v", format, err)
+		}
+
+		bc, err := s.Accept(ctx)
+		if err != nil {
+			t.Fatalf("Accept failed with format %s: %v", format, err)
+		}
+		if bc.Format != format {
+			t.Errorf("Conn.Format == %q, want %q", bc.Format, format)
+		}
+		if !bc.IsResponder || bc.IsRequester {
+			t.Errorf("Conn responder, requester == %t, %t, want true, false", bc.IsResponder, bc.IsRequester)
+		}
+
+		// The first message carries the salt for reconnecting.
+		m, err := tr.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed with format %s: %v", format, err)
+		}
+		if m.Salt == "" {
+			t.Errorf("First message has no salt with format %s", format)
+		}
+
+		req := dslink.NewReq(0, dslink.MethodList)
+		req.Path = "/"
+		rid, err := bc.Send(req)
+		if err != nil {
+			t.Fatalf("Send failed with format %s: %v", format, err)
+		}
+		m, err = tr.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed with format %s: %v", format, err)
+		}
+		if len(m.Reqs) != 1 || m.Reqs[0].Rid != rid || m.Reqs[0].Path != "/" {
+			t.Errorf("Recv() == %v, want list request for / with rid %d", m, rid)
+		}
+
+		// Reconnecting should reuse the handshake with the new salt.
+		tr.Close()
+		tr, err = c.Dial(ctx)
+		if err != nil {
+			t.Fatalf("Redial failed with format %s: %v", format, err)
+		}
+		if _, err = s.Accept(ctx); err != nil {
+			t.Fatalf("Accept after redial failed with format %s: %v", format, err)
+		}
+
+		tr.Close()
+		cancel()
+		s.Close()
+	}
+}
+
+func TestHandshakeOptions(t *testing.T) {
+	s := conntest.NewServer()
+	defer s.Close()
+
+	conf := &config{
+		brokers:     []string{s.URL},
+		name:        "myTest-",
+		keyPath:     filepath.Join(t.TempDir(), ".dslink.key"),
+		isRequester: true,
+		linkData:    map[string]interface{}{"model": "x100"},
+		formats:     []string{"json"},
+	}
+	c, err := newTestClient(conf)
+	if err != nil {
+		t.Fatalf("Unable to create client: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tr, err := c.Dial(ctx)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer tr.Close()
+
+	bc, err := s.Accept(ctx)
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	if bc.Format != "json" {
+		t.Errorf("Conn.Format == %q, want %q", bc.Format, "json")
+	}
+	if bc.LinkData["model"] != "x100" {
+		t.Errorf("Conn.LinkData == %v, want model x100", bc.LinkData)
+	}
+	if bc.Version != dsaVersion {
+		t.Errorf("Conn.Version == %q, want %q", bc.Version, dsaVersion)
+	}
+	if bc.Compression {
+		t.Error("Conn.Compression == true, want false")
+	}
+
+	conf.formats = []string{"xml"}
+	if _, err = newTestClient(conf); err == nil {
+		t.Error("newHttpClient with format xml did not return an error")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	s := conntest.NewServer()
+	defer s.Close()
+
+	for _, enable := range []bool{true, false} {
+		conf := &config{
+			brokers:     []string{s.URL},
+			name:        "myTest-",
+			keyPath:     filepath.Join(t.TempDir(), ".dslink.key"),
+			isResponder: true,
+			compression: enable,
+			compLevel:   defaultCompressionLevel,
+			compThresh:  defaultCompressionThreshold,
+		}
+		c, err := newTestClient(conf)
+		if err != nil {
+			t.Fatalf("Unable to create client: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		tr, err := c.Dial(ctx)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		bc, err := s.Accept(ctx)
+		if err != nil {
+			t.Fatalf("Accept failed: %v", err)
+		}
+
+		if got := tr.(*wsConn).compressed; got != enable {
+			t.Errorf("compressed == %t, want %t", got, enable)
+		}
+
+		// Large responses are compressed and must still arrive intact.
+		r := dslink.NewResp(1)
+		for i := 0; i < 100; i++ {
+			r.AddUpdate("value", "some repetitive text to compress")
+		}
+		if err = tr.Send(&dslink.Message{Msg: 1, Resp: []*dslink.Response{r}}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		got, err := bc.Next(ctx, 1)
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		if len(got.Updates) != 100 {
+			t.Errorf("Received %d updates, want 100", len(got.Updates))
+		}
+
+		tr.Close()
+		cancel()
+	}
+
+	conf := &config{brokers: []string{s.URL}, keyPath: filepath.Join(t.TempDir(), ".dslink.key"), compLevel: 10}
+	if _, err := newTestClient(conf); err == nil {
+		t.Error("newHttpClient with compression level 10 did not return an error")
+	}
+
+	dir := t.TempDir()
+	l := NewLink("Test-", NoFlags, BasePath(dir), Broker(s.URL), CompressionLevel(10))
+	if _, err := l.newFailover(); err == nil {
+		t.Error("newFailover with compression level 10 did not return an error")
+	}
+	if _, err := os.Stat(filepath.Join(dir, defaultKeyPath)); !os.IsNotExist(err) {
+		t.Error("Key was saved although the compression level is invalid")
+	}
+}
+
+// frameConn records whether each websocket frame written by the client is compressed.
+type frameConn struct {
+	net.Conn
+	mu         sync.Mutex
+	handshaked bool
+	compressed []bool
+}
+
+func (c *frameConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	if c.handshaked {
+		// RSV1 in the first byte of the frame marks a compressed message.
+		c.compressed = append(c.compressed, p[0]&0x40 != 0)
+	}
+	c.handshaked = true
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	s := conntest.NewServer()
+	defer s.Close()
+
+	conf := &config{
+		brokers:     []string{s.URL},
+		name:        "myTest-",
+		keyPath:     filepath.Join(t.TempDir(), ".dslink.key"),
+		isResponder: true,
+		compression: true,
+		compLevel:   defaultCompressionLevel,
+		compThresh:  64,
+	}
+	c, err := newTestClient(conf)
+	if err != nil {
+		t.Fatalf("Unable to create client: %v", err)
+	}
+	fc := &frameConn{}
+	c.wsDialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		fc.Conn = conn
+		return fc, err
+	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tr, err := c.Dial(ctx)
 	if err != nil {
 		t.Fatalf("Dial failed: %v", err)
 	}
+	defer tr.Close()
+	bc, err := s.Accept(ctx)
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
 
-	if c == nil {
-		t.Fatal("Connection is nil")
+	large := dslink.NewResp(2)
+	for i := 0; i < 10; i++ {
+		large.AddUpdate("value", "some repetitive text to compress")
+	}
+	for i, r := range []*dslink.Response{dslink.NewResp(1), large} {
+		if err = tr.Send(&dslink.Message{Msg: int32(i + 1), Resp: []*dslink.Response{r}}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		if _, err := bc.Next(ctx, r.Rid); err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if len(fc.compressed) != 2 || fc.compressed[0] || !fc.compressed[1] {
+		t.Errorf("Frames compressed == %v, want [false true]", fc.compressed)
+	}
+}
+
+func TestBrokerAcksPings(t *testing.T) {
+	s := conntest.NewServer()
+	defer s.Close()
+
+	conf := &config{brokers: []string{s.URL}, name: "myTest-", keyPath: filepath.Join(t.TempDir(), ".dslink.key"),
+		isResponder: true, compLevel: defaultCompressionLevel}
+	c, err := newTestClient(conf)
+	if err != nil {
+		t.Fatalf("Unable to create client: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tr, err := c.Dial(ctx)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer tr.Close()
+	if _, err := s.Accept(ctx); err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+
+	// An empty message is a ping, which is acked like any other.
+	if err := tr.Send(&dslink.Message{Msg: 7}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	acked := make(chan bool, 1)
+	go func() {
+		for {
+			m, err := tr.Recv()
+			if err != nil {
+				acked <- false
+				return
+			}
+			if m.Ack == 7 {
+				acked <- true
+				return
+			}
+		}
+	}()
+	select {
+	case ok := <-acked:
+		if !ok {
+			t.Error("Connection closed before the ping was acked")
+		}
+	case <-time.After(time.Second):
+		t.Error("Ping was not acked")
+	}
+}
+
+func TestWsScheme(t *testing.T) {
+	var cases = []struct {
+		scheme, want string
+	}{
+		{"http", "ws"},
+		{"https", "wss"},
+		{"HTTPS", "wss"},
+		{"ws", "ws"},
+		{"wss", "wss"},
+	}
+	for _, c := range cases {
+		got := wsScheme(c.scheme)
+		if got != c.want {
+			t.Errorf("wsScheme(%q) == %q, want %q", c.scheme, got, c.want)
+		}
 	}
 }
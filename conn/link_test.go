@@ -0,0 +1,572 @@
+package conn
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/butlermatt/dslink"
+	"github.com/butlermatt/dslink/conn/conntest"
+	"github.com/butlermatt/dslink/log"
+	"github.com/butlermatt/dslink/nodes"
+)
+
+// recvResponse reads messages from t until it finds a response for rid.
+func recvResponse(t *testing.T, tr Transport, rid int32) *dslink.Response {
+	for {
+		m, err := tr.Recv()
+		if err != nil {
+			t.Fatalf("Recv() returned error: %v", err)
+		}
+		for _, r := range m.Resp {
+			if r.Rid == rid {
+				return r
+			}
+		}
+	}
+}
+
+func TestLinkPipe(t *testing.T) {
+	pl := NewPipeListener()
+	l := NewLink("Test-", NoFlags, TransportDialer(pl.Dial), ReconnectDelay(time.Millisecond, time.Millisecond),
+		DefaultPermission(dslink.PermConfig))
+	l.Init()
+	l.GetProvider().GetRoot().AddChild(nodes.NewNode("Child", l.GetProvider()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- l.Run(ctx)
+	}()
+
+	for i := 0; i < 2; i++ {
+		tr, err := pl.Accept(ctx)
+		if err != nil {
+			t.Fatalf("Accept() returned error: %v", err)
+		}
+
+		req := dslink.NewReq(1, dslink.MethodList)
+		req.Path = "/"
+		go tr.Send(&dslink.Message{Msg: 1, Reqs: []*dslink.Request{req}})
+
+		r := recvResponse(t, tr, 1)
+		if r.Error != nil {
+			t.Fatalf("List returned error: %v", r.Error)
+		}
+		found := false
+		for _, u := range r.Updates {
+			if lu, ok := u.([]interface{}); ok && lu[0] == "Child" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("List / == %v, want update for Child", r.Updates)
+		}
+
+		// Dropping the connection should cause the link to reconnect.
+		tr.Close()
+	}
+
+	cancel()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("Run() == %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run() did not return after cancel")
+	}
+}
+
+func TestLinkBroker(t *testing.T) {
+	s := conntest.NewServer()
+	defer s.Close()
+
+	l := NewLink("Test-", NoFlags, Broker(s.URL), NodesPath(filepath.Join(t.TempDir(), "nodes.json")),
+		Permissions(map[string]dslink.PermType{nodes.DefaultPermit: dslink.PermWrite, "dashboard": dslink.PermRead}))
+	l.conf.keyPath = filepath.Join(t.TempDir(), ".dslink.key")
+	l.Init()
+
+	prov := l.GetProvider()
+	n := nodes.NewNode("Value", prov)
+	n.SetType(dslink.ValueString)
+	n.UpdateValue("Hello")
+	n.EnableSet(dslink.PermWrite, func(dslink.Node, interface{}) bool { return true })
+	prov.GetRoot().AddChild(n)
+
+	n = nodes.NewNode("Action", prov)
+	n.AddAction(func(ctx context.Context, params map[string]interface{}, ret chan<- []interface{}) {
+		ret <- []interface{}{params["in"]}
+		close(ret)
+	}, nil, []dslink.Column{{Name: "out", Type: dslink.ValueString}}, dslink.ResultValues)
+	prov.GetRoot().AddChild(n)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- l.Run(ctx)
+	}()
+
+	c, err := s.Accept(ctx)
+	if err != nil {
+		t.Fatalf("Accept() returned error: %v", err)
+	}
+
+	r, err := c.List(ctx, "/")
+	if err != nil || r.Error != nil {
+		t.Fatalf("List / failed: %v %v", err, r)
+	}
+
+	r, err = c.Subscribe(ctx, "/Value", 1)
+	if err != nil || r.Stream != dslink.StreamClosed {
+		t.Fatalf("Subscribe /Value failed: %v %v", err, r)
+	}
+	r, err = c.Next(ctx, 0)
+	if err != nil {
+		t.Fatalf("Next(0) returned error: %v", err)
+	}
+	if u, ok := r.Updates[0].(map[string]interface{}); !ok || u["value"] != "Hello" {
+		t.Errorf("Subscription update == %v, want value Hello", r.Updates)
+	}
+
+	r, err = c.Set(ctx, "/Value", "World", "dashboard")
+	if err != nil || r.Error == nil || r.Error.Type != dslink.ErrPermissionDenied.Type {
+		t.Fatalf("Set /Value with a read permit == %v %v, want %s", err, r, dslink.ErrPermissionDenied.Type)
+	}
+
+	r, err = c.Set(ctx, "/Value", "World", dslink.PermWrite)
+	if err != nil || r.Error != nil {
+		t.Fatalf("Set /Value failed: %v %v", err, r)
+	}
+	r, err = c.Next(ctx, 0)
+	if err != nil {
+		t.Fatalf("Next(0) returned error: %v", err)
+	}
+	if u, ok := r.Updates[0].(map[string]interface{}); !ok || u["value"] != "World" {
+		t.Errorf("Subscription update == %v, want value World", r.Updates)
+	}
+
+	r, err = c.Invoke(ctx, "/Action", map[string]interface{}{"in": "test"})
+	if err != nil || r.Error != nil {
+		t.Fatalf("Invoke /Action failed: %v %v", err, r)
+	}
+	if r.Stream != dslink.StreamClosed || len(r.Updates) != 1 {
+		t.Errorf("Invoke /Action == %v, want one closed update", r)
+	}
+
+	// The broker acknowledges each message, which gives the latency.
+	for l.Latency() == 0 && ctx.Err() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	if l.Latency() == 0 {
+		t.Error("Latency() == 0 after messages were acknowledged")
+	}
+
+	cancel()
+	if err := <-errc; err != context.Canceled && err != context.DeadlineExceeded {
+		t.Errorf("Run() == %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestLinkState(t *testing.T) {
+	pl := NewPipeListener()
+	var mu sync.Mutex
+	var states []State
+	l := NewLink("Test-", NoFlags, TransportDialer(pl.Dial), ReconnectDelay(time.Millisecond, time.Millisecond),
+		OnStateChange(func(sc StateChange) {
+			mu.Lock()
+			states = append(states, sc.State)
+			mu.Unlock()
+		}))
+	l.Init()
+
+	sc := <-l.StateChanges()
+	if sc.State != StateStopped {
+		t.Errorf("Initial state == %v, want %v", sc.State, StateStopped)
+	}
+	watch := l.StateChanges()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- l.Run(ctx)
+	}()
+
+	var tr Transport
+	for i := 0; i < 2; i++ {
+		if tr != nil {
+			tr.Close()
+		}
+		var err error
+		tr, err = pl.Accept(ctx)
+		if err != nil {
+			t.Fatalf("Accept() returned error: %v", err)
+		}
+		go tr.Send(&dslink.Message{Msg: 1, Salt: "salt"})
+		for l.State().State != StateConnected {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Cancel before closing the transport so the link stops rather than
+	// reporting a disconnect.
+	cancel()
+	tr.Close()
+	<-errc
+
+	want := []State{StateDialing, StateHandshaking, StateConnected, StateDisconnected,
+		StateReconnecting, StateDialing, StateHandshaking, StateConnected, StateStopped}
+	mu.Lock()
+	got := states
+	mu.Unlock()
+	if len(got) != len(want) {
+		t.Fatalf("States == %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("States == %v, want %v", got, want)
+		}
+	}
+
+	var last StateChange
+	n := 0
+	for sc := range watch {
+		last = sc
+		n++
+	}
+	if n != len(want)+1 || last.State != StateStopped {
+		t.Errorf("StateChanges() received %d changes ending with %v, want %d ending with %v", n, last.State, len(want)+1, StateStopped)
+	}
+
+	// Once the link has stopped, a new channel holds the final state only.
+	n = 0
+	for sc := range l.StateChanges() {
+		n++
+		if sc.State != StateStopped {
+			t.Errorf("StateChanges() after Run returned %v, want %v", sc.State, StateStopped)
+		}
+	}
+	if n != 1 {
+		t.Errorf("StateChanges() after Run received %d changes, want 1", n)
+	}
+}
+
+func TestLinkTimeouts(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  func(*config)
+		// drain reads messages from the broker end of the connection.
+		drain bool
+		want  error
+	}{
+		{"read", ReadTimeout(50 * time.Millisecond), true, ErrReadTimeout},
+		{"write", WriteTimeout(50 * time.Millisecond), false, ErrWriteTimeout},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pl := NewPipeListener()
+			errs := make(chan error, 4)
+			l := NewLink("Test-", NoFlags, TransportDialer(pl.Dial), PingInterval(10*time.Millisecond),
+				ReconnectDelay(time.Hour, time.Hour), tc.opt,
+				OnStateChange(func(sc StateChange) {
+					if sc.State == StateDisconnected {
+						errs <- sc.Err
+					}
+				}))
+			l.Init()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			errc := make(chan error, 1)
+			go func() {
+				errc <- l.Run(ctx)
+			}()
+
+			tr, err := pl.Accept(ctx)
+			if err != nil {
+				t.Fatalf("Accept() returned error: %v", err)
+			}
+			if tc.drain {
+				// Receive the initial message and pings, but never reply.
+				go func() {
+					for {
+						if _, err := tr.Recv(); err != nil {
+							return
+						}
+					}
+				}()
+			}
+
+			select {
+			case err := <-errs:
+				if err != tc.want {
+					t.Errorf("Disconnected with error %v, want %v", err, tc.want)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Link did not disconnect")
+			}
+			if tr.State() != TransportClosed {
+				t.Errorf("Transport state == %v, want %v", tr.State(), TransportClosed)
+			}
+
+			cancel()
+			<-errc
+		})
+	}
+}
+
+func TestLinkRequesterDisconnect(t *testing.T) {
+	pl := NewPipeListener()
+	l := NewLink("Test-", NoFlags, IsRequester, TransportDialer(pl.Dial), ReconnectDelay(time.Millisecond, time.Millisecond))
+	l.Init()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- l.Run(ctx)
+	}()
+
+	tr, err := pl.Accept(ctx)
+	if err != nil {
+		t.Fatalf("Accept() returned error: %v", err)
+	}
+	nerr := make(chan error, 1)
+	go func() {
+		_, err := l.GetRequester().GetRemoteNode("/downstream/Other")
+		nerr <- err
+	}()
+	for {
+		m, err := tr.Recv()
+		if err != nil {
+			t.Fatalf("Recv() returned error: %v", err)
+		}
+		if len(m.Reqs) > 0 {
+			break
+		}
+	}
+
+	// The list request is lost along with the connection.
+	tr.Close()
+	select {
+	case err := <-nerr:
+		if err == nil {
+			t.Error("GetRemoteNode() returned no error after the connection was lost")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GetRemoteNode() did not return after the connection was lost")
+	}
+
+	cancel()
+	<-errc
+}
+
+func TestLinkDropsBatchOnReconnect(t *testing.T) {
+	pl := NewPipeListener()
+	l := NewLink("Test-", NoFlags, TransportDialer(pl.Dial), BatchDelay(50*time.Millisecond),
+		ReconnectDelay(time.Millisecond, time.Millisecond))
+	l.Init()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- l.Run(ctx)
+	}()
+
+	tr, err := pl.Accept(ctx)
+	if err != nil {
+		t.Fatalf("Accept() returned error: %v", err)
+	}
+	// The response waits for the batch delay when the connection is lost.
+	l.GetProvider().SendResponse(dslink.NewResp(1))
+	tr.Close()
+
+	if tr, err = pl.Accept(ctx); err != nil {
+		t.Fatalf("Accept() returned error: %v", err)
+	}
+	l.GetProvider().SendResponse(dslink.NewResp(2))
+	for {
+		m, err := tr.Recv()
+		if err != nil {
+			t.Fatalf("Recv() returned error: %v", err)
+		}
+		if len(m.Resp) > 0 {
+			if len(m.Resp) != 1 || m.Resp[0].Rid != 2 {
+				t.Errorf("New connection received %v, want only the response for rid 2", m.Resp)
+			}
+			break
+		}
+	}
+
+	cancel()
+	<-errc
+}
+
+func TestLinkWriteFailureReconnects(t *testing.T) {
+	pl := NewPipeListener()
+	l := NewLink("Test-", NoFlags, TransportDialer(pl.Dial), PingInterval(10*time.Millisecond),
+		WriteTimeout(50*time.Millisecond), ReconnectDelay(time.Millisecond, time.Millisecond))
+	l.Init()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- l.Run(ctx)
+	}()
+
+	tr, err := pl.Accept(ctx)
+	if err != nil {
+		t.Fatalf("Accept() returned error: %v", err)
+	}
+	if _, err := tr.Recv(); err != nil {
+		t.Fatalf("Recv() returned error: %v", err)
+	}
+	// Stop reading, so the next ping blocks until the write timeout, and
+	// send an ack while the link is stuck writing it.
+	time.Sleep(20 * time.Millisecond)
+	go tr.Send(&dslink.Message{Msg: 1, Ack: 1})
+
+	actx, acancel := context.WithTimeout(ctx, time.Second)
+	defer acancel()
+	if _, err := pl.Accept(actx); err != nil {
+		t.Fatalf("Link did not reconnect after a failed write: %v", err)
+	}
+
+	cancel()
+	<-errc
+}
+
+func TestLinkDropsUnencodableMessage(t *testing.T) {
+	s := conntest.NewServer()
+	defer s.Close()
+
+	l := NewLink("Test-", NoFlags, Broker(s.URL), Format("json"), ReconnectDelay(time.Millisecond, time.Millisecond),
+		NodesPath(filepath.Join(t.TempDir(), "nodes.json")),
+		Permissions(map[string]dslink.PermType{nodes.DefaultPermit: dslink.PermRead}))
+	l.conf.keyPath = filepath.Join(t.TempDir(), ".dslink.key")
+	l.Init()
+
+	n := nodes.NewNode("Value", l.GetProvider())
+	n.UpdateValue(math.NaN())
+	l.GetProvider().GetRoot().AddChild(n)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- l.Run(ctx)
+	}()
+
+	c, err := s.Accept(ctx)
+	if err != nil {
+		t.Fatalf("Accept() returned error: %v", err)
+	}
+	// NaN cannot be encoded as json, so the update is dropped.
+	req := dslink.NewReq(0, dslink.MethodSub)
+	req.Paths = []*dslink.SubPath{{Path: "/Value", Sid: 1}}
+	if _, err := c.Send(req); err != nil {
+		t.Fatalf("Send() returned error: %v", err)
+	}
+
+	actx, acancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer acancel()
+	if _, err := s.Accept(actx); err == nil {
+		t.Fatal("Link reconnected after a message could not be encoded")
+	}
+	r, err := c.List(ctx, "/")
+	if err != nil || r.Error != nil {
+		t.Fatalf("List / failed: %v %v", err, r)
+	}
+
+	cancel()
+	<-errc
+}
+
+func TestLinkLogFile(t *testing.T) {
+	dir := t.TempDir()
+	pl := NewPipeListener()
+	l := NewLink("Test-", NoFlags, BasePath(dir), LogFile("link.log"), LogLevel(log.ErrorLevel),
+		TransportDialer(pl.Dial))
+	l.Init()
+	if l.logf == nil {
+		t.Fatal("NewLink did not open the log file")
+	}
+	f := l.logf
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- l.Run(ctx)
+	}()
+	if _, err := pl.Accept(ctx); err != nil {
+		t.Fatalf("Accept() returned error: %v", err)
+	}
+	cancel()
+	<-errc
+
+	if l.logf != nil {
+		t.Error("Run() returned without closing the log file")
+	}
+	if _, err := f.Write([]byte("after\n")); err == nil {
+		t.Error("Log file accepts writes after Run() returned")
+	}
+	// The log file is closed as well when the first connection fails.
+	l = NewLink("Test-", NoFlags, BasePath(dir), LogFile("link.log"), LogLevel(log.ErrorLevel),
+		TransportDialer(func(context.Context) (Transport, error) { return nil, ErrTransportClosed }))
+	l.Init()
+	f = l.logf
+	if err := l.Run(context.Background()); err == nil {
+		t.Fatal("Run() without a broker returned nil")
+	}
+	if _, err := f.Write([]byte("after\n")); err == nil {
+		t.Error("Log file accepts writes after Run() failed to connect")
+	}
+}
+
+func TestLinkUnlimitedMessageSize(t *testing.T) {
+	pl := NewPipeListener()
+	l := NewLink("Test-", NoFlags, TransportDialer(pl.Dial), MaxMessageSize(0), BatchDelay(20*time.Millisecond))
+	l.Init()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- l.Run(ctx)
+	}()
+	tr, err := pl.Accept(ctx)
+	if err != nil {
+		t.Fatalf("Accept() returned error: %v", err)
+	}
+
+	go func() {
+		l.GetProvider().SendResponse(dslink.NewResp(1))
+		l.GetProvider().SendResponse(dslink.NewResp(2))
+	}()
+	// Without a size limit the responses wait for the batch delay, and are
+	// sent together.
+	for {
+		m, err := tr.Recv()
+		if err != nil {
+			t.Fatalf("Recv() returned error: %v", err)
+		}
+		if len(m.Resp) > 0 {
+			if len(m.Resp) != 2 {
+				t.Errorf("Message holds %d responses, want 2", len(m.Resp))
+			}
+			break
+		}
+	}
+
+	cancel()
+	<-errc
+}
@@ -0,0 +1,77 @@
+package conn
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/butlermatt/dslink/log"
+)
+
+// defaultLogRotation rotates the log file every 10MiB and keeps 5 rotated files,
+// so that the log does not fill the disk of small devices.
+var defaultLogRotation = log.Rotation{MaxSize: 10 << 20, MaxBackups: 5}
+
+// LogFile is an option for NewLink. It sets the file the log is written to,
+// relative to the base path. It overrides the --logfile flag and dslink.json.
+// By default the log is written to stderr. The file is closed, and the log
+// sent back to stderr, once Run returns.
+func LogFile(path string) func(c *config) {
+	return func(c *config) {
+		c.logFile = path
+	}
+}
+
+// LogRotation is an option for NewLink. It sets when the log file is rotated,
+// by size or time, how many rotated files are kept and for how long, and
+// whether they are compressed. By default the file is rotated every 10MiB and
+// 5 rotated files are kept.
+func LogRotation(r log.Rotation) func(c *config) {
+	return func(c *config) {
+		c.logRotate = r
+	}
+}
+
+// openLog opens the link's log file and sends the log to it. If the file cannot
+// be opened, the log is left on stderr.
+func (l *Link) openLog() {
+	path := l.conf.path(l.conf.logFile)
+	f, err := log.OpenFile(path, l.conf.logRotate)
+	if err != nil {
+		log.Error.Printf("Unable to open log file %s: %v\n", path, err)
+		return
+	}
+	log.SetOutput(f)
+	l.logf = f
+}
+
+// closeLog sends the log back to stderr and closes the link's log file.
+func (l *Link) closeLog() {
+	log.SetOutput(os.Stderr)
+	if err := l.logf.Close(); err != nil && err != os.ErrClosed {
+		log.Error.Printf("Unable to close log file: %v\n", err)
+	}
+	l.logf = nil
+}
+
+// reopenLog reopens the log file each time the process receives SIGHUP, until
+// ctx is cancelled. This lets logrotate move the file away.
+func (l *Link) reopenLog(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			if err := l.logf.Reopen(); err != nil {
+				l.closeLog()
+				log.Error.Printf("Unable to reopen log file: %v\n", err)
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
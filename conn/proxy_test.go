@@ -0,0 +1,113 @@
+package conn
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/butlermatt/dslink/conn/conntest"
+)
+
+// testProxy is a minimal HTTP proxy which forwards plain requests and
+// tunnels CONNECT requests, requiring basic authentication.
+type testProxy struct {
+	mu      sync.Mutex
+	methods []string
+}
+
+func (p *testProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	if r.Header.Get("Proxy-Authorization") != want {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+
+	p.mu.Lock()
+	p.methods = append(p.methods, r.Method)
+	p.mu.Unlock()
+
+	if r.Method != http.MethodConnect {
+		r.RequestURI = ""
+		r.Header.Del("Proxy-Authorization")
+		res, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer res.Body.Close()
+		for k, v := range res.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(res.StatusCode)
+		io.Copy(w, res.Body)
+		return
+	}
+
+	dst, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	src, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		dst.Close()
+		return
+	}
+	go func() {
+		io.Copy(dst, src)
+		dst.Close()
+	}()
+	io.Copy(src, dst)
+	src.Close()
+}
+
+func TestProxy(t *testing.T) {
+	s := conntest.NewServer()
+	defer s.Close()
+	p := &testProxy{}
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+
+	conf := &config{
+		brokers:     []string{s.URL},
+		name:        "myTest-",
+		keyPath:     filepath.Join(t.TempDir(), ".dslink.key"),
+		isResponder: true,
+		proxy:       "http://user:pass@" + ps.Listener.Addr().String(),
+		proxySet:    true,
+	}
+	c, err := newTestClient(conf)
+	if err != nil {
+		t.Fatalf("Unable to create client: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tr, err := c.Dial(ctx)
+	if err != nil {
+		t.Fatalf("Dial through proxy failed: %v", err)
+	}
+	defer tr.Close()
+	if _, err = s.Accept(ctx); err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.methods) != 2 || p.methods[0] != http.MethodPost || p.methods[1] != http.MethodConnect {
+		t.Errorf("Proxy received %v, want [POST CONNECT]", p.methods)
+	}
+
+	conf.proxy = "://bad"
+	if _, err = newTestClient(conf); err == nil {
+		t.Error("newHttpClient with invalid proxy did not return an error")
+	}
+}
@@ -0,0 +1,98 @@
+package conn
+
+import (
+	"github.com/butlermatt/dslink"
+)
+
+// splitMessage splits m into messages of approximately max bytes or less.
+// Requests and responses are kept whole where they fit. The updates of a
+// response which is too large are spread over parts with the same rid in
+// consecutive messages. Only the last part carries the final stream state
+// and error, and only the first carries the columns. An update larger than
+// max is sent in a message of its own. The ack of m is sent with the first
+// message.
+func splitMessage(m *dslink.Message, max int) []*dslink.Message {
+	if max <= 0 || len(m.Resp)+len(m.Reqs) == 0 {
+		return []*dslink.Message{m}
+	}
+
+	rSizes := make([]int, len(m.Resp))
+	total := 0
+	for i, r := range m.Resp {
+		rSizes[i] = estimateSize(r)
+		total += rSizes[i]
+	}
+	qSizes := make([]int, len(m.Reqs))
+	for i, r := range m.Reqs {
+		qSizes[i] = estimateSize(r)
+		total += qSizes[i]
+	}
+	if total <= max {
+		return []*dslink.Message{m}
+	}
+
+	cur := &dslink.Message{Ack: m.Ack}
+	msgs := []*dslink.Message{cur}
+	size := 0
+	next := func() {
+		cur = &dslink.Message{}
+		msgs = append(msgs, cur)
+		size = 0
+	}
+
+	for i, r := range m.Reqs {
+		if size > 0 && size+qSizes[i] > max {
+			next()
+		}
+		cur.Reqs = append(cur.Reqs, r)
+		size += qSizes[i]
+	}
+
+	for i, r := range m.Resp {
+		if size+rSizes[i] <= max {
+			cur.Resp = append(cur.Resp, r)
+			size += rSizes[i]
+			continue
+		}
+
+		if size > 0 {
+			next()
+		}
+		parts := splitResponse(r, max)
+		for j, p := range parts {
+			if j > 0 {
+				next()
+			}
+			cur.Resp = append(cur.Resp, p)
+		}
+		size = estimateSize(parts[len(parts)-1])
+	}
+	return msgs
+}
+
+// splitResponse spreads the updates of r over parts of approximately max
+// bytes or less.
+func splitResponse(r *dslink.Response, max int) []*dslink.Response {
+	stream := r.Stream
+	if stream == dslink.StreamClosed {
+		stream = dslink.StreamOpen
+	}
+
+	part := &dslink.Response{Rid: r.Rid, Stream: stream, Columns: r.Columns}
+	parts := []*dslink.Response{part}
+	size := estimateSize(part)
+	for _, u := range r.Updates {
+		// Allow for the separating comma.
+		us := estimateSize(u) + 1
+		if len(part.Updates) > 0 && size+us > max {
+			part = &dslink.Response{Rid: r.Rid, Stream: stream}
+			parts = append(parts, part)
+			size = estimateSize(part)
+		}
+		part.Updates = append(part.Updates, u)
+		size += us
+	}
+	part.Stream = r.Stream
+	part.Error = r.Error
+	return parts
+}
@@ -0,0 +1,77 @@
+package conn
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/butlermatt/dslink"
+)
+
+func TestSplitMessage(t *testing.T) {
+	small := &dslink.Message{Ack: 3, Resp: []*dslink.Response{dslink.NewResp(1)}}
+	if msgs := splitMessage(small, 1024); len(msgs) != 1 || msgs[0] != small {
+		t.Errorf("splitMessage of small message == %v, want it unchanged", msgs)
+	}
+
+	list := dslink.NewResp(2)
+	list.Stream = dslink.StreamClosed
+	list.Columns = []map[string]interface{}{{"name": "value", "type": "string"}}
+	for i := 0; i < 500; i++ {
+		list.Updates = append(list.Updates, []interface{}{fmt.Sprintf("child%03d", i), "value"})
+	}
+	other := dslink.NewResp(1)
+	other.Stream = dslink.StreamClosed
+	req := dslink.NewReq(5, dslink.MethodList)
+	req.Path = "/downstream"
+
+	m := &dslink.Message{Ack: 7, Reqs: []*dslink.Request{req}, Resp: []*dslink.Response{other, list}}
+	msgs := splitMessage(m, 1024)
+	if len(msgs) < 2 {
+		t.Fatalf("splitMessage returned %d messages, want more than 1", len(msgs))
+	}
+
+	var parts []*dslink.Response
+	for i, msg := range msgs {
+		if size := estimateSize(msg); size > 1024+128 {
+			t.Errorf("Message %d is %d bytes, want at most about 1024", i, size)
+		}
+		wantAck := int32(0)
+		if i == 0 {
+			wantAck = 7
+		}
+		if msg.Ack != wantAck {
+			t.Errorf("Message %d Ack == %d, want %d", i, msg.Ack, wantAck)
+		}
+		for _, r := range msg.Resp {
+			if r.Rid == list.Rid {
+				parts = append(parts, r)
+			}
+		}
+	}
+	if len(msgs[0].Reqs) != 1 || msgs[0].Resp[0] != other {
+		t.Errorf("First message == %v, want the request and rid 1", msgs[0])
+	}
+
+	n := 0
+	for i, p := range parts {
+		want := dslink.StreamOpen
+		if i == len(parts)-1 {
+			want = dslink.StreamClosed
+		}
+		if p.Stream != want {
+			t.Errorf("Part %d Stream == %q, want %q", i, p.Stream, want)
+		}
+		if hasCols := len(p.Columns) > 0; hasCols != (i == 0) {
+			t.Errorf("Part %d has columns %v", i, p.Columns)
+		}
+		for _, u := range p.Updates {
+			if u.([]interface{})[0] != list.Updates[n].([]interface{})[0] {
+				t.Fatalf("Update %d == %v, want %v", n, u, list.Updates[n])
+			}
+			n++
+		}
+	}
+	if n != len(list.Updates) {
+		t.Errorf("Parts contain %d updates, want %d", n, len(list.Updates))
+	}
+}
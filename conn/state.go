@@ -0,0 +1,154 @@
+package conn
+
+import (
+	"time"
+
+	"github.com/butlermatt/dslink/log"
+)
+
+// State is the connection state of a Link.
+type State int
+
+const (
+	// StateStopped indicates the Link is not running.
+	StateStopped State = iota
+	// StateDialing indicates the Link is connecting to the broker.
+	StateDialing
+	// StateHandshaking indicates a connection has been established and the
+	// Link is waiting for the first message from the broker.
+	StateHandshaking
+	// StateConnected indicates the Link is connected to the broker.
+	StateConnected
+	// StateDisconnected indicates the connection to the broker was lost.
+	StateDisconnected
+	// StateReconnecting indicates the Link is waiting before it tries to
+	// connect to the broker again.
+	StateReconnecting
+)
+
+func (s State) String() string {
+	switch s {
+	case StateStopped:
+		return "stopped"
+	case StateDialing:
+		return "dialing"
+	case StateHandshaking:
+		return "handshaking"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	default:
+		return "unknown"
+	}
+}
+
+// StateChange describes the connection state of a Link at the time it
+// changed.
+type StateChange struct {
+	// State is the new state of the Link.
+	State State
+	// Time is when the Link entered the state.
+	Time time.Time
+	// Broker is the URL of the broker the Link is connected to, or last
+	// tried to connect to. It is empty if the Link uses a TransportDialer.
+	Broker string
+	// Err is the most recent connection error. It is cleared once the Link
+	// is connected again.
+	Err error
+	// DownSince is when the Link last lost, or failed to establish, its
+	// connection to the broker. It is zero while the Link is connected.
+	DownSince time.Time
+}
+
+// StateChangeCB is called with each change of a Link's connection state.
+type StateChangeCB func(StateChange)
+
+// stateWatchBuffer is the number of state changes buffered for each
+// channel returned by StateChanges.
+const stateWatchBuffer = 16
+
+// State returns the current connection state of the Link.
+func (l *Link) State() StateChange {
+	l.stMu.Lock()
+	defer l.stMu.Unlock()
+	return l.state
+}
+
+// StateChanges returns a channel which receives the current connection
+// state of the Link followed by each change of state. If the receiver falls
+// behind, changes are dropped rather than blocking the Link. The channel is
+// closed once the Link has stopped, or right after the current state if Run
+// has already returned.
+func (l *Link) StateChanges() <-chan StateChange {
+	c := make(chan StateChange, stateWatchBuffer)
+	l.stMu.Lock()
+	defer l.stMu.Unlock()
+	c <- l.state
+	if l.ended {
+		close(c)
+		return c
+	}
+	l.watch = append(l.watch, c)
+	return c
+}
+
+// dialing records that the Link is connecting to the broker at addr. err is
+// the error of the previous connection attempt, if any.
+func (l *Link) dialing(addr string, err error) {
+	l.stMu.Lock()
+	l.state.Broker = addr
+	l.stMu.Unlock()
+	l.setState(StateDialing, err)
+}
+
+// setState records a change of the connection state and notifies the
+// OnStateChange callback and StateChanges channels. A nil err keeps the
+// previous error unless the Link is now connected.
+func (l *Link) setState(s State, err error) {
+	l.cbMu.Lock()
+	defer l.cbMu.Unlock()
+
+	l.stMu.Lock()
+	now := time.Now()
+	sc := l.state
+	sc.State = s
+	sc.Time = now
+	if err != nil {
+		sc.Err = err
+	}
+	switch s {
+	case StateConnected:
+		sc.Err = nil
+		sc.DownSince = time.Time{}
+	case StateDisconnected, StateReconnecting, StateStopped:
+		if sc.DownSince.IsZero() {
+			sc.DownSince = now
+		}
+	}
+	l.state = sc
+	l.ended = s == StateStopped
+
+	watchers := l.watch
+	if s == StateStopped {
+		l.watch = nil
+	}
+	l.stMu.Unlock()
+
+	log.Debug.Printf("Link state changed to %v\n", s)
+	if l.conf.onState != nil {
+		l.conf.onState(sc)
+	}
+
+	for _, c := range watchers {
+		select {
+		case c <- sc:
+		default:
+		}
+		if s == StateStopped {
+			close(c)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/butlermatt/dslink"
+)
+
+// ErrTransportClosed is returned by a Transport which has been closed.
+var ErrTransportClosed = errors.New("transport closed")
+
+// EncodeError is returned by Transport.Send when a message cannot be encoded.
+// Nothing was written, so the transport remains usable.
+type EncodeError struct {
+	Err error
+}
+
+func (e *EncodeError) Error() string { return "unable to encode message: " + e.Err.Error() }
+
+func (e *EncodeError) Unwrap() error { return e.Err }
+
+// TransportState reports whether a Transport is able to carry messages.
+type TransportState int
+
+const (
+	// TransportOpen indicates the transport can send and receive messages.
+	TransportOpen TransportState = iota
+	// TransportClosed indicates the transport has been closed or has failed.
+	TransportClosed
+)
+
+func (s TransportState) String() string {
+	switch s {
+	case TransportOpen:
+		return "open"
+	case TransportClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// Transport carries messages between a Link and a broker. Send and Recv
+// may be called concurrently with each other, but each must only be called
+// from one goroutine at a time. Close may be called at any time and causes
+// pending Send and Recv calls to return an error.
+type Transport interface {
+	// Send sends the message to the remote end. It returns an *EncodeError if
+	// the message cannot be encoded, in which case the transport stays open.
+	Send(*dslink.Message) error
+	// Recv blocks until a message is received from the remote end.
+	Recv() (*dslink.Message, error)
+	// Close closes the transport.
+	Close() error
+	// State returns the current state of the transport.
+	State() TransportState
+}
+
+// Dialer establishes a new Transport to the broker. A Link calls its Dialer
+// when it starts and again each time it needs to reconnect.
+type Dialer func(ctx context.Context) (Transport, error)
+
+type pipe struct {
+	in   <-chan *dslink.Message
+	out  chan<- *dslink.Message
+	done chan struct{}
+	once *sync.Once
+}
+
+// Pipe creates a synchronous in-memory Transport. Messages sent on one end
+// are received on the other. Closing either end closes both.
+func Pipe() (Transport, Transport) {
+	a := make(chan *dslink.Message)
+	b := make(chan *dslink.Message)
+	done := make(chan struct{})
+	once := &sync.Once{}
+
+	return &pipe{in: a, out: b, done: done, once: once},
+		&pipe{in: b, out: a, done: done, once: once}
+}
+
+func (p *pipe) Send(m *dslink.Message) error {
+	// Copy the message so the two ends never share it.
+	c := *m
+	select {
+	case p.out <- &c:
+		return nil
+	case <-p.done:
+		return ErrTransportClosed
+	}
+}
+
+func (p *pipe) Recv() (*dslink.Message, error) {
+	select {
+	case m := <-p.in:
+		return m, nil
+	case <-p.done:
+		return nil, ErrTransportClosed
+	}
+}
+
+func (p *pipe) Close() error {
+	p.once.Do(func() {
+		close(p.done)
+	})
+	return nil
+}
+
+func (p *pipe) State() TransportState {
+	select {
+	case <-p.done:
+		return TransportClosed
+	default:
+		return TransportOpen
+	}
+}
+
+// PipeListener connects Links to an in-process broker without a network.
+// Pass its Dial method to NewLink with the TransportDialer option. Each
+// time the Link dials, a new Pipe is created and its remote end is
+// returned by Accept.
+type PipeListener struct {
+	conns chan Transport
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewPipeListener returns a new PipeListener ready to accept connections.
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		conns: make(chan Transport),
+		done:  make(chan struct{}),
+	}
+}
+
+// Dial creates a new Pipe and returns the local end once the remote end has
+// been accepted.
+func (pl *PipeListener) Dial(ctx context.Context) (Transport, error) {
+	local, remote := Pipe()
+	select {
+	case pl.conns <- remote:
+		return local, nil
+	case <-pl.done:
+		return nil, ErrTransportClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Accept blocks until a Link dials, returning the broker end of the new
+// Pipe.
+func (pl *PipeListener) Accept(ctx context.Context) (Transport, error) {
+	select {
+	case t := <-pl.conns:
+		return t, nil
+	case <-pl.done:
+		return nil, ErrTransportClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops the listener. Pending and future calls to Dial and Accept
+// return ErrTransportClosed. Previously accepted transports are unaffected.
+func (pl *PipeListener) Close() error {
+	pl.once.Do(func() {
+		close(pl.done)
+	})
+	return nil
+}
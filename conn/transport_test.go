@@ -0,0 +1,35 @@
+package conn
+
+import (
+	"testing"
+
+	"github.com/butlermatt/dslink"
+)
+
+func TestPipe(t *testing.T) {
+	a, b := Pipe()
+
+	go a.Send(&dslink.Message{Msg: 1})
+	m, err := b.Recv()
+	if err != nil {
+		t.Fatalf("Recv() returned error: %v", err)
+	}
+	if m.Msg != 1 {
+		t.Errorf("Recv() == %v, want msg 1", m)
+	}
+
+	if s := a.State(); s != TransportOpen {
+		t.Errorf("State() == %v, want %v", s, TransportOpen)
+	}
+
+	b.Close()
+	if s := a.State(); s != TransportClosed {
+		t.Errorf("State() after Close == %v, want %v", s, TransportClosed)
+	}
+	if err := a.Send(&dslink.Message{}); err != ErrTransportClosed {
+		t.Errorf("Send() after Close == %v, want %v", err, ErrTransportClosed)
+	}
+	if _, err := a.Recv(); err != ErrTransportClosed {
+		t.Errorf("Recv() after Close == %v, want %v", err, ErrTransportClosed)
+	}
+}
@@ -0,0 +1,120 @@
+package conn
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/butlermatt/dslink"
+	"github.com/butlermatt/dslink/log"
+	"github.com/gorilla/websocket"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	defaultCompressionLevel     = 1
+	defaultCompressionThreshold = 256
+)
+
+type msgFormat int
+
+const (
+	fmtJson msgFormat = iota
+	fmtMsgP
+)
+
+// wsConn is a Transport over a websocket connection to a broker.
+type wsConn struct {
+	client *httpClient
+	conn   *websocket.Conn
+	format msgFormat
+	mu     sync.Mutex
+	closed bool
+	// compressed is true if permessage-deflate was negotiated. Only
+	// messages of at least threshold bytes are then compressed.
+	compressed bool
+	threshold  int
+}
+
+func (c *wsConn) Send(m *dslink.Message) error {
+	t, s, err := c.marshal(m)
+	if err != nil {
+		log.Error.Printf("Error marshalling %+v\nError: %+v\n", *m, err)
+		return &EncodeError{Err: err}
+	}
+	log.Printf("Sent: %v\n", m)
+	if c.compressed {
+		c.conn.EnableWriteCompression(len(s) >= c.threshold)
+	}
+	if err = c.conn.WriteMessage(t, s); err != nil {
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+func (c *wsConn) Recv() (*dslink.Message, error) {
+	for {
+		_, p, err := c.conn.ReadMessage()
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		msg := &dslink.Message{Msg: -1, Ack: -1}
+		if err = c.unmarshal(p, msg); err != nil {
+			log.Error.Printf("Error unmarshalling %s\nError: %v\n", p, err)
+			continue
+		}
+		log.Printf("Recv: %v", msg)
+		if msg.Salt != "" {
+			c.client.setSalt(msg.Salt)
+		}
+		return msg, nil
+	}
+}
+
+func (c *wsConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.conn.Close()
+}
+
+func (c *wsConn) State() TransportState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return TransportClosed
+	}
+	return TransportOpen
+}
+
+func (c *wsConn) marshal(v interface{}) (int, []byte, error) {
+	var f int
+	var d []byte
+	var err error
+	switch c.format {
+	case fmtJson:
+		f = websocket.TextMessage
+		d, err = json.Marshal(v)
+	case fmtMsgP:
+		f = websocket.BinaryMessage
+		d, err = msgpack.Marshal(v)
+	}
+
+	return f, d, err
+}
+
+func (c *wsConn) unmarshal(data []byte, v interface{}) error {
+	var err error
+	switch c.format {
+	case fmtJson:
+		err = json.Unmarshal(data, v)
+	case fmtMsgP:
+		err = msgpack.Unmarshal(data, v)
+	}
+	return err
+}
@@ -20,6 +20,15 @@ const (
 	ValueMap ValueType = "map"
 	// ValueDynamic indicates this value type is an Array
 	ValueArray ValueType = "array"
+	// ValueInt indicates this value type is an integer
+	ValueInt ValueType = "int"
+	// ValueTime indicates this value type is a time, as an RFC 3339 string
+	ValueTime ValueType = "time"
+	// ValueBinary indicates this value type is a byte array
+	ValueBinary ValueType = "binary"
+	// ValueEnum indicates this value type is one of a list of options. The options
+	// are part of the type, see GenerateEnumValue and ParseType.
+	ValueEnum ValueType = "enum"
 )
 
 func GenerateEnumValue(options ...string) ValueType {
@@ -35,9 +44,12 @@ const (
 // PermType is the Permission type.
 type PermType string
 
+// Level returns the level of the permission, or -1 if p is not a valid
+// permission. PermList has the level of PermNone, so use Allows to compare
+// permissions.
 func (p PermType) Level() int {
 	switch p {
-	case PermNone:
+	case PermNone, PermList:
 		return 0
 	case PermRead:
 		return 1
@@ -52,9 +64,31 @@ func (p PermType) Level() int {
 	}
 }
 
+// Allows reports whether the permission p includes the permission need. An
+// invalid permission allows nothing, and nothing allows PermNever.
+func (p PermType) Allows(need PermType) bool {
+	if p.Level() < 0 || need.Level() < 0 || need == PermNever {
+		return false
+	}
+	return p.rank() >= need.rank()
+}
+
+// rank orders the permissions, placing PermList between PermNone and PermRead.
+func (p PermType) rank() int {
+	switch p {
+	case PermNone:
+		return 0
+	case PermList:
+		return 1
+	}
+	return p.Level() + 1
+}
+
 const (
 	// PermNone is permission none.
 	PermNone   PermType = "none"
+	// PermList is permission to list only. It lies between PermNone and PermRead.
+	PermList   PermType = "list"
 	// PermRead is permission Read only
 	PermRead   PermType = "read"
 	// PermWrite is permission write
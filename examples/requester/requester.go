@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	//"github.com/butlermatt/dslink"
 	"github.com/butlermatt/dslink/conn"
@@ -9,10 +10,18 @@ import (
 )
 
 func main() {
-	l := conn.NewLink("MyRequester-", conn.IsRequester, conn.OnConnected(connected))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := conn.NewLink("MyRequester-", conn.IsRequester, conn.OnConnected(func(l *conn.Link) {
+		connected(l)
+		cancel()
+	}))
 	l.Init()
 
-	l.Start()
+	if err := l.Run(ctx); err != nil && err != context.Canceled {
+		fmt.Printf("Link stopped: %v\n", err)
+	}
 }
 
 func connected(l *conn.Link) {
@@ -23,7 +32,6 @@ func connected(l *conn.Link) {
 	testListNode("/downstream/Example", req)
 
 	fmt.Println("Done all!")
-	l.Stop()
 }
 
 func testGetNode(path string, req *nodes.Requester) {
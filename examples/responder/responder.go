@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"time"
 	"github.com/butlermatt/dslink"
@@ -10,7 +11,9 @@ import (
 )
 
 func main() {
-	l := conn.NewLink("MyTest-", conn.OnConnected(connected))
+	// Requests relayed by the broker carry no permit, so grant them write access.
+	l := conn.NewLink("MyTest-", conn.OnConnected(connected),
+		conn.Permissions(map[string]dslink.PermType{nodes.DefaultPermit: dslink.PermWrite}))
 	l.Init()
 
 	prov := l.GetProvider()
@@ -51,10 +54,12 @@ func main() {
 	n.UpdateValue("Hello There!")
 	root.AddChild(n)
 
-	l.Start()
+	if err := l.Run(context.Background()); err != nil {
+		log.Error.Printf("Link stopped: %v\n", err)
+	}
 }
 
-func Tester(params map[string]interface{}, ret chan<-[]interface{}) {
+func Tester(ctx context.Context, params map[string]interface{}, ret chan<-[]interface{}) {
 	log.Println("I'm in the invoke!")
 
 	log.Printf("Got params: %v\n", params)
@@ -0,0 +1,245 @@
+package log
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupFormat is the format of the timestamp appended to the name of a rotated log file.
+const backupFormat = "20060102-150405.000000"
+
+// Rotation configures when a log File is rotated and which rotated files are kept.
+type Rotation struct {
+	// MaxSize is the size in bytes after which the file is rotated. 0 disables rotation by size.
+	MaxSize int64
+	// RotateEvery is how long the file is written to before it is rotated. 0 disables rotation by time.
+	RotateEvery time.Duration
+	// MaxAge is how long rotated files are kept. Older ones are removed. 0 keeps them regardless of age.
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files kept. Older ones are removed. 0 keeps all of them.
+	MaxBackups int
+	// Compress gzips the rotated files.
+	Compress bool
+}
+
+// File is a log file which is rotated according to its Rotation. A rotated file is
+// renamed with the time of the rotation appended to its name, such as
+// link.log.20060102-150405.000000, followed by .gz if it is compressed.
+// File can be passed to SetOutput. Rotated files are compressed and removed in
+// the background, and Close waits for them.
+type File struct {
+	path   string
+	rot    Rotation
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+	aMu    sync.Mutex
+	wg     sync.WaitGroup
+}
+
+// OpenFile opens the log file at path for appending, creating it and its directory if needed.
+func OpenFile(path string, r Rotation) (*File, error) {
+	f := &File{path: path, rot: r}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	f.f = fd
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+// Write writes p to the file, first rotating it if p would take it past its MaxSize
+// or it was opened at least RotateEvery ago. If the file cannot be rotated, p is
+// written to it regardless.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	full := f.rot.MaxSize > 0 && f.size+int64(len(p)) > f.rot.MaxSize
+	due := f.rot.RotateEvery > 0 && time.Since(f.opened) >= f.rot.RotateEvery
+	if f.size > 0 && (full || due) {
+		// The log is writing to this file, so errors are reported on stderr instead.
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to rotate log file %s: %v\n", f.path, err)
+		}
+	}
+
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotate rotates the file now.
+func (f *File) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		return os.ErrClosed
+	}
+	return f.rotate()
+}
+
+// rotate renames the file and opens a new one in its place. The current file is
+// kept open until the new one is, so the log is not lost if rotation fails.
+func (f *File) rotate() error {
+	backup := f.path + "." + time.Now().Format(backupFormat)
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	old := f.f
+	if err := f.open(); err != nil {
+		os.Rename(backup, f.path)
+		return err
+	}
+	old.Close()
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		f.archive(backup)
+	}()
+	return nil
+}
+
+// archive compresses the rotated file backup if configured and removes the rotated
+// files which are no longer kept. The log may be writing to this file, so errors
+// are reported on stderr instead.
+func (f *File) archive(backup string) {
+	f.aMu.Lock()
+	defer f.aMu.Unlock()
+	if f.rot.Compress {
+		if err := compress(backup); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to compress log file %s: %v\n", backup, err)
+		}
+	}
+	if err := f.prune(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to remove old log files: %v\n", err)
+	}
+}
+
+// Reopen closes and reopens the file, such as after it has been moved by logrotate.
+func (f *File) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f != nil {
+		f.f.Close()
+		f.f = nil
+	}
+	return f.open()
+}
+
+// Close closes the file and waits for rotated files to be compressed and removed.
+// Writes fail once it is closed.
+func (f *File) Close() error {
+	f.mu.Lock()
+	if f.f == nil {
+		f.mu.Unlock()
+		return os.ErrClosed
+	}
+	err := f.f.Close()
+	f.f = nil
+	f.mu.Unlock()
+
+	f.wg.Wait()
+	return err
+}
+
+// Backups returns the paths of the rotated files, oldest first.
+func (f *File) Backups() ([]string, error) {
+	names, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, n := range names {
+		ts := strings.TrimSuffix(strings.TrimPrefix(n, f.path+"."), ".gz")
+		if _, err := time.Parse(backupFormat, ts); err == nil {
+			backups = append(backups, n)
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// prune removes the rotated files older than MaxAge and the oldest ones beyond
+// MaxBackups.
+func (f *File) prune() error {
+	backups, err := f.Backups()
+	if err != nil {
+		return err
+	}
+	for f.rot.MaxAge > 0 && len(backups) > 0 {
+		ts := strings.TrimSuffix(strings.TrimPrefix(backups[0], f.path+"."), ".gz")
+		rotated, _ := time.ParseInLocation(backupFormat, ts, time.Local)
+		if time.Since(rotated) <= f.rot.MaxAge {
+			break
+		}
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	for f.rot.MaxBackups > 0 && len(backups) > f.rot.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// compress gzips the file at path to path.gz and removes it.
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		in.Close()
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	in.Close()
+	if cerr := gz.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,136 @@
+package log
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "link.log")
+	f, err := OpenFile(path, Rotation{MaxSize: 10, MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatalf("OpenFile returned error: %v", err)
+	}
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write returned error: %v", err)
+		}
+	}
+	// Close waits for the rotated files to be compressed.
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	if d, _ := ioutil.ReadFile(path); string(d) != "fourth\n" {
+		t.Errorf("Log file contains %q, want %q", d, "fourth\n")
+	}
+	backups, err := f.Backups()
+	if err != nil {
+		t.Fatalf("Backups returned error: %v", err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("Backups() == %v, want 2 files", backups)
+	}
+	for i, want := range []string{"second\n", "third\n"} {
+		if !strings.HasSuffix(backups[i], ".gz") {
+			t.Errorf("Backup %s was not compressed", backups[i])
+			continue
+		}
+		r, err := os.Open(backups[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, _ := ioutil.ReadAll(gz)
+		r.Close()
+		if string(d) != want {
+			t.Errorf("Backup %s contains %q, want %q", backups[i], d, want)
+		}
+	}
+}
+
+func TestFileMaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "link.log")
+	old := path + "." + time.Now().Add(-2*time.Hour).Format(backupFormat)
+	if err := ioutil.WriteFile(old, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenFile(path, Rotation{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatalf("OpenFile returned error: %v", err)
+	}
+
+	f.Write([]byte("recent\n"))
+	if err := f.Rotate(); err != nil {
+		t.Fatalf("Rotate returned error: %v", err)
+	}
+	f.Close()
+
+	backups, _ := f.Backups()
+	if len(backups) != 1 || backups[0] == old {
+		t.Errorf("Backups() == %v, want only the recent file", backups)
+	}
+}
+
+func TestFileRotateEvery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "link.log")
+	f, err := OpenFile(path, Rotation{RotateEvery: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("OpenFile returned error: %v", err)
+	}
+
+	f.Write([]byte("first\n"))
+	f.Write([]byte("second\n"))
+	time.Sleep(30 * time.Millisecond)
+	f.Write([]byte("third\n"))
+	f.Close()
+
+	backups, _ := f.Backups()
+	if len(backups) != 1 {
+		t.Fatalf("Backups() == %v, want one rotated file", backups)
+	}
+	if d, _ := ioutil.ReadFile(backups[0]); string(d) != "first\nsecond\n" {
+		t.Errorf("Rotated file contains %q, want %q", d, "first\nsecond\n")
+	}
+	if d, _ := ioutil.ReadFile(path); string(d) != "third\n" {
+		t.Errorf("Log file contains %q, want %q", d, "third\n")
+	}
+}
+
+func TestFileReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "link.log")
+	f, err := OpenFile(path, Rotation{})
+	if err != nil {
+		t.Fatalf("OpenFile returned error: %v", err)
+	}
+	defer f.Close()
+
+	f.Write([]byte("before\n"))
+	// logrotate moves the file away, then signals the link to reopen it.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatalf("Reopen returned error: %v", err)
+	}
+	f.Write([]byte("after\n"))
+
+	if d, _ := ioutil.ReadFile(path + ".1"); string(d) != "before\n" {
+		t.Errorf("Moved file contains %q, want %q", d, "before\n")
+	}
+	if d, _ := ioutil.ReadFile(path); string(d) != "after\n" {
+		t.Errorf("Reopened file contains %q, want %q", d, "after\n")
+	}
+	if b, _ := f.Backups(); len(b) != 0 {
+		t.Errorf("Backups() == %v, want none", b)
+	}
+}
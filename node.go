@@ -1,6 +1,7 @@
 package dslink
 
 import (
+	"context"
 	"time"
 )
 
@@ -61,10 +62,14 @@ func (p Params) Set(key ParamVal, val interface{}) {
 	p[key] = val
 }
 
-type InvokeFn func(map[string]interface{}, chan<-[]interface{})
+// InvokeFn is called when an action is invoked. It receives the invoke parameters and
+// sends result rows to the channel, which it must close when done. The context is
+// cancelled when the requester closes the invocation or the link is stopped, and the
+// function should return promptly once that happens.
+type InvokeFn func(context.Context, map[string]interface{}, chan<-[]interface{})
 
 type Invokable interface {
-	Invoke(*Request)
+	Invoke(context.Context, *Request)
 }
 
 type ValueUpdate struct {
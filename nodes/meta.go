@@ -0,0 +1,183 @@
+package nodes
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/butlermatt/dslink"
+)
+
+// linkConfigs are the configs which are set up by the link along with the behaviour
+// of the node, so requesters may not change them.
+var linkConfigs = map[dslink.NodeConfig]bool{
+	dslink.ConfigIs:         true,
+	dslink.ConfigInvokable:  true,
+	dslink.ConfigParams:     true,
+	dslink.ConfigColumns:    true,
+	dslink.ConfigResult:     true,
+	dslink.ConfigStreamMeta: true,
+}
+
+// splitMetaPath splits the path of an attribute or config, such as /node/@name, into
+// the path of its node and its name. It returns false if path addresses a node.
+func splitMetaPath(path string) (node, name string, ok bool) {
+	i := strings.LastIndex(path, "/")
+	if i == -1 || i == len(path)-1 {
+		return "", "", false
+	}
+	name = path[i+1:]
+	if name[0] != '@' && name[0] != '$' {
+		return "", "", false
+	}
+	node = path[:i]
+	if node == "" {
+		node = "/"
+	}
+	return node, name, true
+}
+
+// RemoveAttribute removes the attribute name from the node, returning its value.
+func (n *LocalNode) RemoveAttribute(name string) (interface{}, bool) {
+	n.aMu.Lock()
+	v, ok := n.attr[name]
+	delete(n.attr, name)
+	n.aMu.Unlock()
+	if ok {
+		n.notifyRemove(name)
+		n.changed()
+	}
+	return v, ok
+}
+
+// RemoveConfig removes the config name from the node, returning its value.
+func (n *LocalNode) RemoveConfig(name dslink.NodeConfig) (interface{}, bool) {
+	n.aMu.Lock()
+	v, ok := n.conf[name]
+	delete(n.conf, name)
+	if name == dslink.ConfigType {
+		n.valType = ""
+	}
+	n.aMu.Unlock()
+	if ok {
+		n.notifyConfigs(name)
+		n.changed()
+	}
+	return v, ok
+}
+
+// setMeta handles a set request on the attribute or config name of the node. Setting
+// an attribute requires the write permission and a config the config permission.
+func (n *LocalNode) setMeta(req *dslink.Request, name string) *dslink.MsgErr {
+	if name[0] == '@' {
+		if err := n.allow(req, dslink.PermWrite); err != nil {
+			return err
+		}
+		v, err := validateAttribute(name, req.Value)
+		if err != nil {
+			return &dslink.MsgErr{Type: dslink.ErrInvalidValue.Type, Msg: err.Error(), Path: req.Path}
+		}
+		n.markRequested(name)
+		n.SetAttribute(name, v)
+		return nil
+	}
+
+	if err := n.allow(req, dslink.PermConfig); err != nil {
+		return err
+	}
+	c := dslink.NodeConfig(name)
+	v, err := validateConfig(c, req.Value)
+	if err != nil {
+		return &dslink.MsgErr{Type: dslink.ErrInvalidValue.Type, Msg: err.Error(), Path: req.Path}
+	}
+	n.markRequested(name)
+	if c == dslink.ConfigType {
+		n.SetType(v.(dslink.ValueType))
+	} else {
+		n.SetConfig(c, v)
+	}
+	return nil
+}
+
+// removeMeta handles a remove request on the attribute or config name of the node,
+// which requires the same permission as setting it.
+func (n *LocalNode) removeMeta(req *dslink.Request, name string) *dslink.MsgErr {
+	if name[0] == '@' {
+		if err := n.allow(req, dslink.PermWrite); err != nil {
+			return err
+		}
+		n.markRequested(name)
+		n.RemoveAttribute(name)
+	} else {
+		if err := n.allow(req, dslink.PermConfig); err != nil {
+			return err
+		}
+		c := dslink.NodeConfig(name)
+		if linkConfigs[c] {
+			return &dslink.MsgErr{Type: dslink.ErrInvalidValue.Type, Msg: fmt.Sprintf("%s is set up by the link", c), Path: req.Path}
+		}
+		n.markRequested(name)
+		n.RemoveConfig(c)
+	}
+	return nil
+}
+
+// markRequested records that a requester set or removed the attribute or config
+// name, so the change is restored from nodes.json over the link's own value.
+func (n *LocalNode) markRequested(name string) {
+	n.aMu.Lock()
+	if n.requested == nil {
+		n.requested = make(map[string]bool)
+	}
+	n.requested[name] = true
+	n.aMu.Unlock()
+}
+
+// validateAttribute checks that v is a valid value for the attribute name set by a
+// requester, and returns it in the form stored by the node.
+func validateAttribute(name string, v interface{}) (interface{}, error) {
+	switch name {
+	case dslink.AttrUnit:
+		return dslink.Type{Kind: dslink.ValueString}.Coerce(v)
+	case dslink.AttrPrecision:
+		p, err := dslink.Type{Kind: dslink.ValueInt}.Coerce(v)
+		if i, _ := p.(int64); err != nil || i < 0 {
+			return nil, fmt.Errorf("%#v is not a valid %s", v, name)
+		}
+		return p, nil
+	}
+	return v, nil
+}
+
+// validateConfig checks that v is a valid value for the config c set by a requester,
+// and returns it in the form stored by the node.
+func validateConfig(c dslink.NodeConfig, v interface{}) (interface{}, error) {
+	if linkConfigs[c] {
+		return nil, fmt.Errorf("%s is set up by the link", c)
+	}
+
+	switch c {
+	case dslink.ConfigName:
+		if _, ok := v.(string); !ok {
+			return nil, fmt.Errorf("%#v is not a valid %s", v, c)
+		}
+	case dslink.ConfigType:
+		s, _ := v.(string)
+		if _, err := dslink.ParseType(dslink.ValueType(s)); s == "" || err != nil {
+			return nil, fmt.Errorf("%#v is not a valid %s", v, c)
+		}
+		return dslink.ValueType(s), nil
+	case dslink.ConfigWritable:
+		p := toPerm(v)
+		if p.Level() < 0 {
+			return nil, fmt.Errorf("%#v is not a valid %s", v, c)
+		}
+		return p, nil
+	case dslink.ConfigPermissions:
+		p, err := parsePermissions(v)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	return v, nil
+}
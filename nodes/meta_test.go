@@ -0,0 +1,248 @@
+package nodes
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/butlermatt/dslink"
+)
+
+func TestSetRemoveMeta(t *testing.T) {
+	resp := make(chan *dslink.Response, 10)
+	p := NewProvider(resp)
+	p.GetRoot().SetConfig(dslink.ConfigPermissions, map[string]dslink.PermType{
+		DefaultPermit: dslink.PermRead,
+		"operator":    dslink.PermWrite,
+		"admin":       dslink.PermConfig,
+	})
+	n := NewNode("Pump", p)
+	p.GetRoot().AddChild(n)
+
+	list := dslink.NewReq(1, dslink.MethodList)
+	list.Path = "/Pump"
+	list.Permit = "operator"
+	p.HandleRequest(list)
+
+	// List updates sent before the response to a request are kept for nextUpdate.
+	var updates []*dslink.Response
+	request := func(method dslink.MethodType, path, permit string, v interface{}) *dslink.MsgErr {
+		req := dslink.NewReq(2, method)
+		req.Path = path
+		req.Permit = permit
+		req.Value = v
+		p.HandleRequest(req)
+		for {
+			r := <-resp
+			if r.Rid == 2 {
+				return r.Error
+			}
+			updates = append(updates, r)
+		}
+	}
+	nextUpdate := func() interface{} {
+		var r *dslink.Response
+		if len(updates) > 0 {
+			r, updates = updates[0], updates[1:]
+		} else {
+			r = <-resp
+		}
+		if r.Rid != 1 || len(r.Updates) != 1 {
+			t.Fatalf("List update == %v", r)
+		}
+		return r.Updates[0]
+	}
+
+	if err := request(dslink.MethodSet, "/Pump/@location", "", "Basement"); err != dslink.ErrPermissionDenied {
+		t.Errorf("Set @location with a read permit returned %v", err)
+	}
+	if err := request(dslink.MethodSet, "/Pump/@location", "operator", "Basement"); err != nil {
+		t.Fatalf("Set @location returned error: %v", err)
+	}
+	if u := nextUpdate(); !reflect.DeepEqual(u, []interface{}{"@location", "Basement"}) {
+		t.Errorf("List update == %v, want @location", u)
+	}
+	if err := request(dslink.MethodSet, "/Pump/$name", "operator", "Main pump"); err != dslink.ErrPermissionDenied {
+		t.Errorf("Set $name with a write permit returned %v", err)
+	}
+
+	invalid := []struct {
+		path string
+		v    interface{}
+	}{
+		{"/Pump/$writable", "always"},
+		{"/Pump/$is", "other"},
+		{"/Pump/$type", 1},
+		{"/Pump/@precision", -1},
+	}
+	for _, c := range invalid {
+		if err := request(dslink.MethodSet, c.path, "admin", c.v); err == nil || err.Type != dslink.ErrInvalidValue.Type {
+			t.Errorf("Set %s to %#v returned %v, want %s", c.path, c.v, err, dslink.ErrInvalidValue.Type)
+		}
+	}
+
+	if err := request(dslink.MethodSet, "/Pump/$writable", "admin", "write"); err != nil {
+		t.Fatalf("Set $writable returned error: %v", err)
+	}
+	nextUpdate()
+	if err := request(dslink.MethodSet, "/Pump", "operator", 3); err != nil {
+		t.Errorf("Set value of node made writable returned error: %v", err)
+	}
+
+	if err := request(dslink.MethodRemove, "/Pump/@location", "operator", nil); err != nil {
+		t.Fatalf("Remove @location returned error: %v", err)
+	}
+	if u := nextUpdate(); !reflect.DeepEqual(u, map[string]string{"name": "@location", "change": "remove"}) {
+		t.Errorf("List update == %v, want removal of @location", u)
+	}
+	if _, ok := n.GetAttribute("@location"); ok {
+		t.Error("@location was not removed")
+	}
+	if err := request(dslink.MethodRemove, "/Pump", "admin", nil); err != dslink.ErrInvalidMethod {
+		t.Errorf("Remove of a node returned %v, want %v", err, dslink.ErrInvalidMethod)
+	}
+
+	// Changes made by requesters are saved along with the tree.
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	request(dslink.MethodSet, "/Pump/@owner", "operator", "ops")
+	nextUpdate()
+	if err := p.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	p2 := NewProvider(make(chan *dslink.Response))
+	if err := p2.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if o, _ := p2.GetNode("/Pump").GetAttribute("@owner"); o != "ops" {
+		t.Errorf("Restored @owner == %v, want ops", o)
+	}
+}
+
+func TestListNotifyBatch(t *testing.T) {
+	resp := make(chan *dslink.Response, 10)
+	p := NewProvider(resp)
+	p.GetRoot().SetConfig(dslink.ConfigPermissions, map[string]dslink.PermType{DefaultPermit: dslink.PermConfig})
+	n := NewNode("Sensor", p)
+	p.GetRoot().AddChild(n)
+
+	for rid, path := range map[int32]string{1: "/", 2: "/Sensor"} {
+		req := dslink.NewReq(rid, dslink.MethodList)
+		req.Path = path
+		p.HandleRequest(req)
+	}
+
+	n.SetConfig(dslink.ConfigName, "Sensor 1")
+	n.SetConfig(dslink.ConfigName, "Temperature")
+	n.SetAttribute(dslink.AttrPrecision, 2)
+	n.SetValueType(dslink.Type{Kind: dslink.ValueNum, Unit: "°C"})
+	n.SetAttribute("@location", "Roof")
+	n.RemoveAttribute("@location")
+
+	got := make(map[int32][]interface{})
+	for len(got) < 2 {
+		r := <-resp
+		if _, ok := got[r.Rid]; ok {
+			t.Fatalf("Changes were sent to list %d in more than one response", r.Rid)
+		}
+		got[r.Rid] = r.Updates
+	}
+
+	// Updates are in the order names first changed, with their last change.
+	want := []interface{}{
+		[]interface{}{"$name", "Temperature"},
+		map[string]string{"name": "@precision", "change": "remove"},
+		[]interface{}{"$type", dslink.ValueNum},
+		[]interface{}{"@unit", "°C"},
+		map[string]string{"name": "@location", "change": "remove"},
+	}
+	if !reflect.DeepEqual(got[2], want) {
+		t.Errorf("Updates of /Sensor ==\n%v\nwant\n%v", got[2], want)
+	}
+	if len(got[1]) != 1 {
+		t.Fatalf("Updates of / == %v, want the summary of Sensor", got[1])
+	}
+	if u, _ := got[1][0].([]interface{}); u[0] != "Sensor" || u[1].(map[string]interface{})["$name"] != "Temperature" {
+		t.Errorf("Update of / == %v, want the summary of Sensor", got[1][0])
+	}
+}
+
+func TestListNotifyChild(t *testing.T) {
+	defer func(d time.Duration) { listDelay = d }(listDelay)
+	listDelay = time.Hour
+
+	resp := make(chan *dslink.Response, 10)
+	p := NewProvider(resp)
+	n := NewNode("Area", p)
+	p.GetRoot().AddChild(n)
+	for _, rid := range []int32{1, 2} {
+		req := dslink.NewReq(rid, dslink.MethodList)
+		req.Path = "/Area"
+		req.Permit = string(dslink.PermRead)
+		p.HandleRequest(req)
+	}
+
+	// The queued change is sent along with the new child, without waiting.
+	n.SetConfig(dslink.ConfigName, "Roof")
+	n.AddChild(NewNode("Sensor", p))
+	var got []*dslink.Response
+	for len(got) < 2 {
+		select {
+		case r := <-resp:
+			got = append(got, r)
+		case <-time.After(time.Second):
+			t.Fatal("Added child was not sent to the list subscribers")
+		}
+	}
+	for _, r := range got {
+		if len(r.Updates) != 2 {
+			t.Errorf("Updates of list %d == %v, want $name and Sensor", r.Rid, r.Updates)
+		}
+	}
+	// Each subscriber gets its own updates, which the link may change.
+	got[0].Updates[0] = nil
+	if got[1].Updates[0] == nil {
+		t.Error("List subscribers share their updates")
+	}
+}
+
+func TestListWait(t *testing.T) {
+	defer func(d time.Duration) { listDelay = d }(listDelay)
+	listDelay = time.Hour
+
+	resp := make(chan *dslink.Response, 10)
+	p := NewProvider(resp)
+	ctx, cancel := context.WithCancel(context.Background())
+	p.SetContext(ctx)
+	n := NewNode("Area", p)
+	p.GetRoot().AddChild(n)
+	req := dslink.NewReq(1, dslink.MethodList)
+	req.Path = "/Area"
+	req.Permit = string(dslink.PermRead)
+	p.HandleRequest(req)
+
+	// The queued update is sent by Wait instead of after listDelay.
+	n.SetConfig(dslink.ConfigName, "Roof")
+	waitProvider(t, p)
+	select {
+	case r := <-resp:
+		if len(r.Updates) != 1 {
+			t.Errorf("Updates == %v, want $name", r.Updates)
+		}
+	default:
+		t.Error("Wait did not send the queued list update")
+	}
+
+	// The node may still change while the link shuts down.
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			n.SetConfig(dslink.ConfigName, i)
+		}
+	}()
+	waitProvider(t, p)
+	<-done
+}
@@ -1,13 +1,17 @@
 package nodes
 
 import (
+	"context"
+	"strings"
 	"sync"
+	"time"
 	"github.com/butlermatt/dslink"
 	"github.com/butlermatt/dslink/log"
 )
 
 type LocalNode struct {
 	provider    *Provider
+	aMu         sync.RWMutex
 	attr        map[string]interface{}
 	conf        map[dslink.NodeConfig]interface{}
 	Parent      *LocalNode
@@ -25,8 +29,20 @@ type LocalNode struct {
 	lMu         sync.RWMutex
 	listSubs    []int32
 	onSet       dslink.OnSetValue
+	transient   bool
+	nMu         sync.Mutex
+	pending     []string
+	changes     map[string]interface{}
+	listTimer   *time.Timer
+	listDone    chan struct{}
+	requested   map[string]bool
 }
 
+// listDelay is how long the changes to a node are collected before they are
+// sent to its list subscribers, so that a burst of changes is sent together.
+// Children added or removed are sent at once.
+var listDelay = 10 * time.Millisecond
+
 func (n *LocalNode) Name() string {
 	return n.name
 }
@@ -36,12 +52,18 @@ func (n *LocalNode) Attributes() map[string]interface{} {
 }
 
 func (n *LocalNode) GetAttribute(name string) (interface{}, bool) {
+	n.aMu.RLock()
+	defer n.aMu.RUnlock()
 	a, ok := n.attr[name]
 	return a, ok
 }
 
 func (n *LocalNode) SetAttribute(name string, v interface{}) {
+	n.aMu.Lock()
 	n.attr[name] = v
+	n.aMu.Unlock()
+	n.notifyList(name, v)
+	n.changed()
 }
 
 func (n *LocalNode) Configs() map[dslink.NodeConfig]interface{} {
@@ -49,12 +71,25 @@ func (n *LocalNode) Configs() map[dslink.NodeConfig]interface{} {
 }
 
 func (n *LocalNode) GetConfig(name dslink.NodeConfig) (interface{}, bool) {
+	n.aMu.RLock()
+	defer n.aMu.RUnlock()
 	c, ok := n.conf[name]
 	return c, ok
 }
 
 func (n *LocalNode) SetConfig(name dslink.NodeConfig, value interface{}) {
+	n.aMu.Lock()
 	n.conf[name] = value
+	n.aMu.Unlock()
+	n.notifyConfigs(name)
+	n.changed()
+}
+
+// changed records that the node has changed and the node tree needs to be saved.
+func (n *LocalNode) changed() {
+	if p := n.provider; p != nil {
+		p.markDirty()
+	}
 }
 
 func (n *LocalNode) Children() map[string]*LocalNode {
@@ -77,7 +112,8 @@ func (n *LocalNode) AddChild(nd *LocalNode) error {
 	n.chld[nd.name] = nd
 	n.cMu.Unlock()
 
-	n.notifyList(nd.name, nd.ToMap())
+	n.notifyChild(nd.name, listUpdate(nd.name, nd.ToMap()))
+	n.changed()
 
 	return nil
 }
@@ -112,26 +148,147 @@ func (n *LocalNode) RemoveChild(name string) dslink.Node {
 
 	if nd != nil {
 		nd.Remove()
-		n.lMu.RLock()
-		defer n.lMu.RUnlock()
-		for _, i := range n.listSubs {
-			r := dslink.NewResp(i)
-			r.Updates = append(r.Updates, map[string]string{"name": name, "change": "remove"})
-			n.provider.SendResponse(r)
-		}
+		n.changed()
+		n.notifyChild(name, removeUpdate(name))
 	}
 
 	return nd
 }
 
+// notifyList sends the new value of the child, attribute or config name to the
+// list subscribers of the node.
 func (n *LocalNode) notifyList(name string, value interface{}) {
+	n.queueList(name, listUpdate(name, value))
+}
+
+// notifyRemove sends the removal of the child, attribute or config name to the
+// list subscribers of the node.
+func (n *LocalNode) notifyRemove(name string) {
+	n.queueList(name, removeUpdate(name))
+}
+
+// notifyChild sends the addition or removal of a child to the list subscribers of
+// the node right away, along with the changes queued before it, so requesters
+// browsing the tree see new children without waiting for listDelay.
+func (n *LocalNode) notifyChild(name string, update interface{}) {
+	n.queueList(name, update)
+	n.flushList()
+}
+
+// listUpdate returns the list update setting name to value.
+func listUpdate(name string, value interface{}) interface{} {
+	var r dslink.Response
+	r.AddUpdate(name, value)
+	return r.Updates[0]
+}
+
+// removeUpdate returns the list update removing name.
+func removeUpdate(name string) interface{} {
+	return map[string]string{"name": name, "change": "remove"}
+}
+
+// notifyConfigs sends the new values of the configs names to the list subscribers
+// of the node. Its summary in the list of its parent is updated as well. Changes to
+// the private $$ configs are not sent, as not every subscriber may see them.
+func (n *LocalNode) notifyConfigs(names ...dslink.NodeConfig) {
+	for _, name := range names {
+		if strings.HasPrefix(string(name), "$$") {
+			continue
+		}
+		if v, ok := n.GetConfig(name); ok {
+			n.notifyList(string(name), v)
+		} else {
+			n.notifyRemove(string(name))
+		}
+	}
+	if p := n.Parent; p != nil {
+		p.notifyList(n.name, n.ToMap())
+	}
+}
+
+// queueList queues the update of name for the list subscribers of the node. The
+// updates queued within listDelay are sent in a single response to each
+// subscriber, and only the last update of each name is kept.
+func (n *LocalNode) queueList(name string, update interface{}) {
 	n.lMu.RLock()
-	defer n.lMu.RUnlock()
-	for _, i := range n.listSubs {
-		r := &dslink.Response{Rid: i}
-		r.AddUpdate(name, value)
-		n.provider.SendResponse(r)
+	subs := len(n.listSubs)
+	n.lMu.RUnlock()
+	prov := n.provider
+	if subs == 0 || prov == nil {
+		return
+	}
+
+	n.nMu.Lock()
+	defer n.nMu.Unlock()
+	if n.changes == nil {
+		n.changes = make(map[string]interface{})
+		// done is closed once the timer's flush has finished, for waitList.
+		done := make(chan struct{})
+		n.listDone = done
+		n.listTimer = time.AfterFunc(listDelay, func() {
+			defer close(done)
+			n.flushList()
+		})
+		prov.queueFlush(n)
+	}
+	if _, ok := n.changes[name]; !ok {
+		n.pending = append(n.pending, name)
+	}
+	n.changes[name] = update
+}
+
+// flushList sends the queued updates to the list subscribers of the node. Each
+// subscriber gets its own copy of the updates.
+func (n *LocalNode) flushList() {
+	n.nMu.Lock()
+	if n.listTimer != nil {
+		// The timer's flush has nothing left to send if it still runs.
+		if n.listTimer.Stop() {
+			close(n.listDone)
+		}
+		n.listTimer = nil
+		n.listDone = nil
+		if n.provider != nil {
+			n.provider.flushed(n)
+		}
+	}
+	if len(n.pending) == 0 {
+		n.nMu.Unlock()
+		return
+	}
+	updates := make([]interface{}, 0, len(n.pending))
+	for _, name := range n.pending {
+		updates = append(updates, n.changes[name])
+	}
+	n.pending = nil
+	n.changes = nil
+	n.nMu.Unlock()
+
+	prov := n.provider
+	if prov == nil {
+		return
 	}
+	n.lMu.RLock()
+	subs := append([]int32(nil), n.listSubs...)
+	n.lMu.RUnlock()
+	for _, i := range subs {
+		r := dslink.NewResp(i)
+		r.Updates = append([]interface{}(nil), updates...)
+		prov.SendResponse(r)
+	}
+}
+
+// waitList sends the queued updates to the list subscribers of the node without
+// waiting for listDelay, and waits for a flush already started by the timer.
+func (n *LocalNode) waitList() {
+	n.nMu.Lock()
+	done := n.listDone
+	n.nMu.Unlock()
+	if done == nil {
+		return
+	}
+	n.flushList()
+	<-done
 }
 
 func (n *LocalNode) notifySubs(update *dslink.ValueUpdate) {
@@ -157,11 +314,14 @@ func (n *LocalNode) List(request *dslink.Request) *dslink.Response {
 	r := dslink.NewResp(request.Rid)
 	r.Stream = dslink.StreamOpen
 
-	is, _ := n.GetConfig(dslink.ConfigIs)
-	r.AddUpdate(dslink.ConfigIs, is)
+	// $$ configs are private to requesters with the config permission.
+	private := n.Permission(request.Permit) == dslink.PermConfig
+
+	n.aMu.RLock()
+	r.AddUpdate(dslink.ConfigIs, n.conf[dslink.ConfigIs])
 
 	for k, v := range n.conf {
-		if k == dslink.ConfigIs {
+		if k == dslink.ConfigIs || strings.HasPrefix(string(k), "$$") && !private {
 			continue
 		}
 		r.AddUpdate(k, v)
@@ -170,6 +330,7 @@ func (n *LocalNode) List(request *dslink.Request) *dslink.Response {
 	for k, v := range n.attr {
 		r.AddUpdate(k, v)
 	}
+	n.aMu.RUnlock()
 
 	n.cMu.RLock()
 	for name, nd := range n.chld {
@@ -223,6 +384,8 @@ func (n *LocalNode) Unsubscribe(sid int32) {
 }
 
 func (n *LocalNode) ToMap() map[string]interface{} {
+	n.aMu.RLock()
+	defer n.aMu.RUnlock()
 	m := make(map[string]interface{})
 	m[string(dslink.ConfigIs)] = n.conf[dslink.ConfigIs]
 	name, ok := n.conf[dslink.ConfigName]
@@ -247,12 +410,57 @@ func (n *LocalNode) ToMap() map[string]interface{} {
 }
 
 func (n *LocalNode) GetType() dslink.ValueType {
+	n.aMu.RLock()
+	defer n.aMu.RUnlock()
 	return n.valType
 }
 
 func (n *LocalNode) SetType(t dslink.ValueType) {
+	n.aMu.Lock()
 	n.conf[dslink.ConfigType] = t
 	n.valType = t
+	n.aMu.Unlock()
+	n.notifyConfigs(dslink.ConfigType)
+	n.changed()
+}
+
+// Type returns the type of the value of the node, from its $type config and its
+// @unit and @precision attributes.
+func (n *LocalNode) Type() dslink.Type {
+	n.aMu.RLock()
+	defer n.aMu.RUnlock()
+	return dslink.TypeOf(n.valType, n.attr)
+}
+
+// SetValueType sets the $type config of the node and its @unit and @precision
+// attributes from t. Unit and precision attributes which t does not set are removed.
+func (n *LocalNode) SetValueType(t dslink.Type) {
+	vt := t.ValueType()
+	n.aMu.Lock()
+	n.conf[dslink.ConfigType] = vt
+	n.valType = vt
+	attrs := t.Attributes()
+	var removed []string
+	for _, k := range []string{dslink.AttrUnit, dslink.AttrPrecision} {
+		if _, ok := n.attr[k]; ok {
+			removed = append(removed, k)
+		}
+		delete(n.attr, k)
+	}
+	for k, v := range attrs {
+		n.attr[k] = v
+	}
+	n.aMu.Unlock()
+	n.notifyConfigs(dslink.ConfigType)
+	for _, k := range removed {
+		if _, ok := attrs[k]; !ok {
+			n.notifyRemove(k)
+		}
+	}
+	for k, v := range attrs {
+		n.notifyList(k, v)
+	}
+	n.changed()
 }
 
 func (n *LocalNode) AddAction(fn dslink.InvokeFn, params []dslink.Params, cols []dslink.Column, result string) {
@@ -265,7 +473,6 @@ func (n *LocalNode) AddAction(fn dslink.InvokeFn, params []dslink.Params, cols [
 		}
 		p = append(p, m)
 	}
-	n.conf[dslink.ConfigParams] = p
 
 	var columns []map[string]interface{}
 	for _, c := range cols {
@@ -277,12 +484,20 @@ func (n *LocalNode) AddAction(fn dslink.InvokeFn, params []dslink.Params, cols [
 		}
 		columns = append(columns, m)
 	}
+	n.aMu.Lock()
 	n.columns = columns
+	n.conf[dslink.ConfigParams] = p
 	n.conf[dslink.ConfigColumns] = columns
 	n.conf[dslink.ConfigInvokable] = dslink.PermWrite
 	n.conf[dslink.ConfigResult] = result
+	n.aMu.Unlock()
+	n.notifyConfigs(dslink.ConfigParams, dslink.ConfigColumns, dslink.ConfigInvokable, dslink.ConfigResult)
+	n.changed()
 }
 
+// UpdateValue sets the value of the node and sends it to the subscribers. Unlike
+// a value set by a requester, it does not mark the node tree as changed, as
+// values which are polled change continuously. AutoSave saves them periodically.
 func (n *LocalNode) UpdateValue(v interface{}) {
 	n.vMu.Lock()
 	n.value = v
@@ -298,30 +513,28 @@ func (n *LocalNode) Value() interface{} {
 	return n.value
 }
 
-func (n *LocalNode) Invoke(req *dslink.Request) {
+// Invoke calls the action function of this node with the parameters of req, sending
+// the results to the requester. The invocation is abandoned when ctx is cancelled,
+// though Invoke does not return until the action function has finished.
+func (n *LocalNode) Invoke(ctx context.Context, req *dslink.Request) {
 	r := dslink.NewResp(req.Rid)
 
-	perm := dslink.PermType(req.Permit)
-	if perm == "" || perm.Level() == -1 {
-		perm = dslink.PermConfig
-	}
-
 	pr, ok := n.GetConfig(dslink.ConfigInvokable)
-	prs, _ := pr.(string)
 	if !ok {
 		r.Error = dslink.ErrInvalidMethod
 		n.provider.SendResponse(r)
 		return
 	}
 
-	permReq := dslink.PermType(prs)
-	if perm.Level() < permReq.Level() {
-		r.Error = dslink.ErrPermissionDenied
+	if err := n.allow(req, toPerm(pr)); err != nil {
+		r.Error = err
 		n.provider.SendResponse(r)
 		return
 	}
 
+	n.aMu.RLock()
 	r.Columns = n.columns
+	n.aMu.RUnlock()
 
 	if n.onInvoke == nil {
 		empty := []interface{}{}
@@ -333,84 +546,100 @@ func (n *LocalNode) Invoke(req *dslink.Request) {
 	s, _ := rType.(string)
 
 	retChan := make(chan []interface{})
-	go n.onInvoke(req.Params, retChan)
+	go n.onInvoke(ctx, req.Params, retChan)
+	// Wait for the invoke function to finish, even if ctx is cancelled,
+	// so that it is never left blocked sending on retChan.
+	defer func() {
+		for range retChan {
+		}
+	}()
 
 	if s != dslink.ResultStream {
 		r.Stream = dslink.StreamClosed
-		for u := range retChan {
-			r.Updates = append(r.Updates, u)
+		for {
+			select {
+			case u, ok := <-retChan:
+				if !ok {
+					n.provider.SendResponse(r)
+					return
+				}
+				r.Updates = append(r.Updates, u)
+			case <-ctx.Done():
+				return
+			}
 		}
-		n.provider.SendResponse(r)
-		return
 	}
 
-	var up [][]interface{}
 	r.Stream = dslink.StreamOpen
 	for {
 		select {
 		case data, ok := <-retChan:
 			if !ok {
-				retChan = nil
-			} else {
-				up = append(up, data)
+				r.Stream = dslink.StreamClosed
+				n.provider.SendResponse(r)
+				return
 			}
-		default:
-			if len(up) == 0 {
-				continue
+			r.Updates = append(r.Updates, data)
+			// Collect any other pending updates before sending.
+		PENDING:
+			for {
+				select {
+				case data, ok = <-retChan:
+					if !ok {
+						r.Stream = dslink.StreamClosed
+						n.provider.SendResponse(r)
+						return
+					}
+					r.Updates = append(r.Updates, data)
+				default:
+					break PENDING
+				}
 			}
-			for _, u := range up {
-				r.Updates = append(r.Updates, u)
-			}
-			up = up[:0]
 			n.provider.SendResponse(r)
 			r = dslink.NewResp(req.Rid)
-			//r.Stream = dslink.StreamOpen
-
-		}
-		if retChan == nil {
-			break
+		case <-ctx.Done():
+			return
 		}
 	}
-
-	if len(up) > 0 {
-		r.Stream = dslink.StreamClosed
-		for _, u := range up {
-			r.Updates = append(r.Updates, u)
-		}
-		n.provider.SendResponse(r)
-	}
 }
 
+// Set handles a set request on the value of the node. The value is validated and
+// coerced according to the node's ValueType before it is passed to the OnSetValue
+// callback, and rejected with ErrInvalidValue if it does not match.
 func (n *LocalNode) Set(req *dslink.Request) *dslink.MsgErr {
-	perm := dslink.PermType(req.Permit)
-	if perm == "" || perm.Level() == -1 {
-		perm = dslink.PermConfig
-	}
-
 	pr, ok := n.GetConfig(dslink.ConfigWritable)
-	prs, _ := pr.(string)
 	if !ok {
 		return dslink.ErrInvalidValue
 	}
 
-	permReq := dslink.PermType(prs)
-	if perm.Level() < permReq.Level() {
-		return dslink.ErrPermissionDenied
+	if err := n.allow(req, toPerm(pr)); err != nil {
+		return err
 	}
 
-	ok = n.onSet(n, req.Value)
-	if !ok {
+	v, err := n.GetType().Coerce(req.Value)
+	if err != nil {
+		return &dslink.MsgErr{Type: dslink.ErrInvalidValue.Type, Msg: err.Error(), Path: req.Path}
+	}
+
+	// Nodes made writable by a requester or restored from nodes.json may not
+	// have a callback.
+	if n.onSet != nil && !n.onSet(n, v) {
 		return nil
 	}
 
-	n.UpdateValue(req.Value)
+	n.UpdateValue(v)
+	n.changed()
 
 	return nil
 }
 
 func (n *LocalNode) EnableSet(perm dslink.PermType, onSet dslink.OnSetValue) {
+	n.aMu.Lock()
 	n.conf[dslink.ConfigWritable] = perm
+	n.aMu.Unlock()
 	n.onSet = onSet
+	n.notifyConfigs(dslink.ConfigWritable)
+	n.changed()
 }
 
 func NewNode(name string, provider *Provider) *LocalNode {
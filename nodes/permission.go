@@ -0,0 +1,151 @@
+package nodes
+
+import (
+	"fmt"
+
+	"github.com/butlermatt/dslink"
+)
+
+// DefaultPermit is the key of the $$permissions entry which applies to the permits,
+// including a missing one, that have no entry of their own.
+const DefaultPermit = "default"
+
+// Permission returns the permission granted on the node to requests with the
+// specified permit. The $$permissions config maps permits to permissions, such as
+//
+//	{"operator": "config", "dashboard": "read", "default": "list"}
+//
+// and is inherited by the children of the node. The entry for the permit, or else
+// the default entry, of the nearest node defining one applies. A permit without
+// an entry is granted PermNone where $$permissions is set, even if it names a
+// permission, so requesters cannot grant themselves more. Without $$permissions
+// on the node or its parents, a permit which is a permission such as "read" is
+// granted as is, and any other permit, including a missing one, is granted the
+// least privilege, PermNone, unless Provider.SetDefaultPermission says otherwise.
+// The result is never above PermConfig.
+func (n *LocalNode) Permission(permit string) dslink.PermType {
+	perm := dslink.PermNone
+	if dslink.PermType(permit).Level() >= 0 {
+		perm = dslink.PermType(permit)
+	} else if n.provider != nil {
+		perm = n.provider.DefaultPermission()
+	}
+
+	for nd := n; nd != nil; nd = nd.Parent {
+		c, ok := nd.GetConfig(dslink.ConfigPermissions)
+		if !ok {
+			continue
+		}
+		perm = dslink.PermNone
+		perms := permissions(c)
+		if p, ok := perms[permit]; ok && permit != "" {
+			perm = p
+			break
+		}
+		if p, ok := perms[DefaultPermit]; ok {
+			perm = p
+			break
+		}
+	}
+
+	if perm.Level() > dslink.PermConfig.Level() {
+		return dslink.PermConfig
+	}
+	return perm
+}
+
+// SetDefaultPermission sets the permission granted to requests whose permit is
+// missing or names no permission, on nodes without $$permissions on themselves or
+// their parents. It defaults to PermNone. Granting more, such as PermConfig, keeps
+// links which predate permission checks working, but lets any requester in.
+func (s *Provider) SetDefaultPermission(p dslink.PermType) {
+	s.dMu.Lock()
+	defer s.dMu.Unlock()
+	s.defPerm = p
+}
+
+// DefaultPermission returns the permission set by SetDefaultPermission.
+func (s *Provider) DefaultPermission() dslink.PermType {
+	s.dMu.RLock()
+	defer s.dMu.RUnlock()
+	if s.defPerm.Level() < 0 {
+		return dslink.PermNone
+	}
+	return s.defPerm
+}
+
+// allow returns ErrPermissionDenied unless the permit of req grants at least the
+// permission need on the node. A need of PermNever is never granted.
+func (n *LocalNode) allow(req *dslink.Request, need dslink.PermType) *dslink.MsgErr {
+	if !n.Permission(req.Permit).Allows(need) {
+		return dslink.ErrPermissionDenied
+	}
+	return nil
+}
+
+// permissions converts the value of a $$permissions config to a map of permits to
+// permissions. Invalid entries are ignored.
+func permissions(v interface{}) map[string]dslink.PermType {
+	m, _ := parsePermissions(v)
+	return m
+}
+
+// parsePermissions converts the value of a $$permissions config to a map of permits
+// to permissions. It accepts a map, as set by the link or decoded from json or
+// msgpack, or the DSA list of [permit, permission] pairs. It returns the valid
+// entries, along with an error if any entry or v itself is invalid.
+func parsePermissions(v interface{}) (map[string]dslink.PermType, error) {
+	m := make(map[string]dslink.PermType)
+	var err error
+	add := func(k, p interface{}) {
+		ks, ok := k.(string)
+		if pt := toPerm(p); ok && pt.Level() >= 0 {
+			m[ks] = pt
+		} else if err == nil {
+			err = fmt.Errorf("invalid permission entry %v: %v", k, p)
+		}
+	}
+
+	switch ps := v.(type) {
+	case map[string]dslink.PermType:
+		for k, p := range ps {
+			add(k, p)
+		}
+	case map[string]string:
+		for k, p := range ps {
+			add(k, p)
+		}
+	case map[string]interface{}:
+		for k, p := range ps {
+			add(k, p)
+		}
+	case map[interface{}]interface{}:
+		for k, p := range ps {
+			add(k, p)
+		}
+	case []interface{}:
+		for _, e := range ps {
+			if pair, ok := e.([]interface{}); ok && len(pair) == 2 {
+				add(pair[0], pair[1])
+			} else if err == nil {
+				err = fmt.Errorf("invalid permission entry %v", e)
+			}
+		}
+	case nil:
+	default:
+		err = fmt.Errorf("%#v is not a valid map or list of permissions", v)
+	}
+	return m, err
+}
+
+// toPerm converts the value of a permission config, such as $writable, which is a
+// PermType when set by the link or a string when restored from nodes.json.
+func toPerm(v interface{}) dslink.PermType {
+	switch p := v.(type) {
+	case dslink.PermType:
+		return p
+	case string:
+		return dslink.PermType(p)
+	}
+	return ""
+}
@@ -0,0 +1,113 @@
+package nodes
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/butlermatt/dslink"
+	"github.com/butlermatt/dslink/log"
+)
+
+// profilePath is the path of the node under which profile definitions are published.
+const profilePath = "/defs/profile"
+
+// NodeConstructor attaches the behaviour of a profile to a node, such as its action,
+// OnSetValue callback or any polling. It is called once the node has been added to
+// its parent, before the rest of the node is restored from nodes.json.
+type NodeConstructor func(n *LocalNode)
+
+// Profile is a type of node, identified by the $is config of its nodes.
+type Profile struct {
+	// Name is the $is config of the nodes of the profile.
+	Name string
+	// Constructor attaches the behaviour of the profile to its nodes. It may be nil.
+	Constructor NodeConstructor
+	// Configs and Attributes are shared by all nodes of the profile, such as the
+	// $params and $columns of an action. They are published at /defs/profile/<Name>.
+	Configs    map[dslink.NodeConfig]interface{}
+	Attributes map[string]interface{}
+}
+
+// RegisterProfile adds the profile p to the Provider, replacing any profile with the
+// same name, and publishes its definition at /defs/profile/<name>. Nodes restored
+// from nodes.json or created with CreateChild whose $is is the name of p are set up
+// by its Constructor.
+func (s *Provider) RegisterProfile(p Profile) {
+	s.pMu.Lock()
+	s.profiles[p.Name] = p
+	s.pMu.Unlock()
+
+	defs := s.profileNode()
+	defs.RemoveChild(p.Name)
+	d := NewNode(p.Name, s)
+	for k, v := range p.Configs {
+		d.conf[k] = v
+	}
+	for k, v := range p.Attributes {
+		d.attr[k] = v
+	}
+	defs.AddChild(d)
+}
+
+// Profile returns the profile registered with the specified name.
+func (s *Provider) Profile(name string) (Profile, bool) {
+	s.pMu.RLock()
+	defer s.pMu.RUnlock()
+	p, ok := s.profiles[name]
+	return p, ok
+}
+
+// profileNode returns the node containing the profile definitions, creating it if
+// needed. The definitions are not saved to nodes.json.
+func (s *Provider) profileNode() *LocalNode {
+	n := s.root
+	for _, name := range strings.Split(strings.TrimPrefix(profilePath, "/"), "/") {
+		c, _ := n.GetChild(name).(*LocalNode)
+		if c == nil {
+			c = NewNode(name, s)
+			c.transient = true
+			n.AddChild(c)
+		}
+		n = c
+	}
+	return n
+}
+
+// CreateChild creates a node of the profile named is and adds it to n as the child
+// name. The Constructor of the profile is then called to set up the node. It returns
+// an error if no such profile has been registered.
+func (n *LocalNode) CreateChild(name, is string) (*LocalNode, error) {
+	p, ok := n.provider.Profile(is)
+	if !ok {
+		return nil, fmt.Errorf("Unknown profile: %q", is)
+	}
+	return n.addProfileChild(name, p), nil
+}
+
+// addProfileChild creates the child name of the profile p.
+func (n *LocalNode) addProfileChild(name string, p Profile) *LocalNode {
+	c := NewNode(name, n.provider)
+	c.conf[dslink.ConfigIs] = p.Name
+	n.AddChild(c)
+	if p.Constructor != nil {
+		p.Constructor(c)
+	}
+	return c
+}
+
+// restoreChild creates the child name from its contents m in nodes.json. If the
+// child's profile is registered, its Constructor sets up the node.
+func (n *LocalNode) restoreChild(name string, m map[string]interface{}) *LocalNode {
+	is, _ := m[string(dslink.ConfigIs)].(string)
+	if is == "" {
+		is = "node"
+	}
+	p, ok := n.provider.Profile(is)
+	if !ok {
+		if is != "node" {
+			log.Warn.Printf("Unknown profile %q of node %s/%s\n", is, n.path, name)
+		}
+		p = Profile{Name: is}
+	}
+	return n.addProfileChild(name, p)
+}
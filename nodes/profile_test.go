@@ -0,0 +1,72 @@
+package nodes
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/butlermatt/dslink"
+)
+
+func TestProfileRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	counter := Profile{
+		Name: "counter",
+		Configs: map[dslink.NodeConfig]interface{}{
+			dslink.ConfigType: dslink.ValueNum,
+		},
+		Attributes: map[string]interface{}{"@unit": "clicks"},
+	}
+
+	p := NewProvider(make(chan *dslink.Response))
+	p.RegisterProfile(counter)
+	if _, err := p.GetRoot().CreateChild("Missing", "unknown"); err == nil {
+		t.Error("CreateChild with an unknown profile did not return an error")
+	}
+	n, err := p.GetRoot().CreateChild("Counter", "counter")
+	if err != nil {
+		t.Fatalf("CreateChild returned error: %v", err)
+	}
+	n.SetConfig(dslink.ConfigName, "My Counter")
+	n.UpdateValue(3)
+	if err := p.Save(path); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+
+	// The restarted link registers the profile again before loading the tree.
+	p2 := NewProvider(make(chan *dslink.Response))
+	var built []string
+	counter.Constructor = func(n *LocalNode) {
+		built = append(built, n.path)
+		n.SetType(dslink.ValueNum)
+		n.EnableSet(dslink.PermWrite, func(dslink.Node, interface{}) bool { return true })
+	}
+	p2.RegisterProfile(counter)
+	if err := p2.Load(path); err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+
+	if len(built) != 1 || built[0] != "/Counter" {
+		t.Fatalf("Constructor called for %v, want only /Counter", built)
+	}
+	c := p2.GetNode("/Counter")
+	if c.onSet == nil {
+		t.Error("Restored node does not have the profile's OnSetValue callback")
+	}
+	if name, _ := c.GetConfig(dslink.ConfigName); name != "My Counter" {
+		t.Errorf("$name == %v, want %v", name, "My Counter")
+	}
+	if v := c.Value(); v != 3.0 {
+		t.Errorf("Value() == %v, want %v", v, 3.0)
+	}
+
+	d := p2.GetNode("/defs/profile/counter")
+	if d == nil {
+		t.Fatal("Profile definition was not published at /defs/profile/counter")
+	}
+	if u, _ := d.GetAttribute("@unit"); u != "clicks" {
+		t.Errorf("Definition attribute @unit == %v, want %v", u, "clicks")
+	}
+	if _, ok := p2.GetRoot().Serialize()["defs"]; ok {
+		t.Error("Serialize included the profile definitions")
+	}
+}
@@ -1,6 +1,7 @@
 package nodes
 
 import (
+	"context"
 	"sync"
 	"github.com/butlermatt/dslink"
 	"github.com/butlermatt/dslink/log"
@@ -15,6 +16,68 @@ type Provider struct {
 	cache       map[string]*LocalNode
 	sMu         sync.RWMutex
 	subscribers map[int32]dslink.Valued
+	qos         map[int32]uint8
+	ctx         context.Context
+	iMu         sync.Mutex
+	invokes     map[int32]*invocation
+	wg          sync.WaitGroup
+	dirty       chan struct{}
+	pMu         sync.RWMutex
+	profiles    map[string]Profile
+	dMu         sync.RWMutex
+	defPerm     dslink.PermType
+	fMu         sync.Mutex
+	flushes     map[*LocalNode]bool
+}
+
+// invocation is an in-flight invocation of an action, which is cancelled when
+// the requester closes it.
+type invocation struct {
+	cancel context.CancelFunc
+}
+
+// SetContext sets the context which controls the lifetime of the Provider. Once ctx is
+// cancelled, pending responses are dropped and in-flight invocations are cancelled.
+func (s *Provider) SetContext(ctx context.Context) {
+	s.iMu.Lock()
+	defer s.iMu.Unlock()
+	s.ctx = ctx
+}
+
+// Wait blocks until all goroutines started by the Provider, such as in-flight invocations,
+// have exited. List updates still queued are sent, or dropped once the context is cancelled.
+func (s *Provider) Wait() {
+	s.wg.Wait()
+
+	s.fMu.Lock()
+	nodes := make([]*LocalNode, 0, len(s.flushes))
+	for n := range s.flushes {
+		nodes = append(nodes, n)
+	}
+	s.fMu.Unlock()
+	for _, n := range nodes {
+		n.waitList()
+	}
+}
+
+// queueFlush records that the list updates of n are queued, so Wait covers them.
+func (s *Provider) queueFlush(n *LocalNode) {
+	s.fMu.Lock()
+	defer s.fMu.Unlock()
+	s.flushes[n] = true
+}
+
+// flushed records that the list updates of n are no longer queued.
+func (s *Provider) flushed(n *LocalNode) {
+	s.fMu.Lock()
+	defer s.fMu.Unlock()
+	delete(s.flushes, n)
+}
+
+func (s *Provider) context() context.Context {
+	s.iMu.Lock()
+	defer s.iMu.Unlock()
+	return s.ctx
 }
 
 // GetNode will attempt to return the Node located at the Specified path.
@@ -57,7 +120,11 @@ func (s *Provider) RemoveNode(path string) *LocalNode {
 // SendResponse is used by provider and node implementations for Responders to send an async response back to the
 // remote requester.
 func (s *Provider) SendResponse(resp *dslink.Response) {
-	s.c <- resp
+	select {
+	case s.c <- resp:
+	case <-s.context().Done():
+		log.Debug.Printf("Provider stopped, dropping response for Rid: %d\n", resp.Rid)
+	}
 }
 
 // HandleRequest must be implemented by a Responder to handle incoming requests. It may return a Response
@@ -76,6 +143,8 @@ func (s *Provider) HandleRequest(req *dslink.Request) *dslink.Response {
 		s.handleInvoke(req)
 	case dslink.MethodSet:
 		s.handleSet(req)
+	case dslink.MethodRemove:
+		s.handleRemove(req)
 	default:
 		log.Debug.Printf("Unhandled method: %s", req.Method)
 	}
@@ -92,6 +161,12 @@ func (s *Provider) handleList(req *dslink.Request) *dslink.Response {
 		r.Error = dslink.ErrInvalidPath
 		return r
 	}
+	if err := nd.allow(req, dslink.PermList); err != nil {
+		r := dslink.NewResp(req.Rid)
+		r.Stream = dslink.StreamClosed
+		r.Error = err
+		return r
+	}
 
 	s.lMu.Lock()
 	s.listResp[req.Rid] = nd
@@ -107,6 +182,14 @@ func (s *Provider) handleList(req *dslink.Request) *dslink.Response {
 }
 
 func (s *Provider) handleClose(req *dslink.Request) {
+	s.iMu.Lock()
+	inv := s.invokes[req.Rid]
+	delete(s.invokes, req.Rid)
+	s.iMu.Unlock()
+	if inv != nil {
+		inv.cancel()
+	}
+
 	s.lMu.Lock()
 	defer s.lMu.Unlock()
 
@@ -121,15 +204,35 @@ func (s *Provider) handleSub(req *dslink.Request) *dslink.Response {
 	r := dslink.NewResp(req.Rid)
 	r.Stream = dslink.StreamClosed
 
-	var newSubs []int32
-	for _, p := range req.Paths {
+	// The request is rejected as a whole if any of its nodes may not be read,
+	// as the response cannot report errors for each path.
+	nodes := make([]*LocalNode, len(req.Paths))
+	for i, p := range req.Paths {
 		s.cMu.RLock()
-		n := s.cache[p.Path]
+		nodes[i] = s.cache[p.Path]
 		s.cMu.RUnlock()
 
+		if nodes[i] == nil {
+			log.Debug.Printf("Unable to subscribe to missing node %s\n", p.Path)
+			continue
+		}
+		if err := nodes[i].allow(req, dslink.PermRead); err != nil {
+			r.Error = err
+			return r
+		}
+	}
+
+	var newSubs []int32
+	for i, p := range req.Paths {
+		n := nodes[i]
+		if n == nil {
+			continue
+		}
+
 		newSubs = append(newSubs, p.Sid)
 		s.sMu.Lock()
 		s.subscribers[p.Sid] = n
+		s.qos[p.Sid] = p.Qos
 		s.sMu.Unlock()
 		n.Subscribe(p.Sid)
 	}
@@ -146,7 +249,11 @@ func (s *Provider) handleSub(req *dslink.Request) *dslink.Response {
 		}
 	}
 
-	go s.SendResponse(r2)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.SendResponse(r2)
+	}()
 
 	return r
 }
@@ -162,31 +269,114 @@ func (s *Provider) handleUnsub(req *dslink.Request) *dslink.Response {
 			nd.Unsubscribe(i)
 		}
 		delete(s.subscribers, i)
+		delete(s.qos, i)
 		s.sMu.Unlock()
 	}
 
 	return r
 }
 
-func (s *Provider) handleInvoke(req *dslink.Request) {
-	s.cMu.RLock()
-	n := s.cache[req.Path]
-	s.cMu.RUnlock()
+// Qos returns the quality of service level requested for the subscription with the
+// specified sid.
+func (s *Provider) Qos(sid int32) uint8 {
+	s.sMu.RLock()
+	defer s.sMu.RUnlock()
+	return s.qos[sid]
+}
+
+// Reset drops the state of the requests made over a connection which was lost,
+// as the broker makes them again once the link reconnects. Subscriptions and list
+// streams are closed and in-flight invocations are cancelled.
+func (s *Provider) Reset() {
+	s.iMu.Lock()
+	invokes := s.invokes
+	s.invokes = make(map[int32]*invocation)
+	s.iMu.Unlock()
+	for _, inv := range invokes {
+		inv.cancel()
+	}
+
+	s.lMu.Lock()
+	for rid, nd := range s.listResp {
+		nd.Close(dslink.NewReq(rid, dslink.MethodClose))
+	}
+	s.listResp = make(map[int32]dslink.Lister)
+	s.lMu.Unlock()
 
-	go n.Invoke(req)
+	s.sMu.Lock()
+	for sid, nd := range s.subscribers {
+		nd.Unsubscribe(sid)
+	}
+	s.subscribers = make(map[int32]dslink.Valued)
+	s.qos = make(map[int32]uint8)
+	s.sMu.Unlock()
 }
 
-func (s *Provider) handleSet(req *dslink.Request) {
+func (s *Provider) handleInvoke(req *dslink.Request) {
 	s.cMu.RLock()
 	n := s.cache[req.Path]
 	s.cMu.RUnlock()
 
-	err := n.Set(req)
-	if err != nil {
+	if n == nil {
 		r := dslink.NewResp(req.Rid)
-		r.Error = err
+		r.Stream = dslink.StreamClosed
+		r.Error = dslink.ErrInvalidPath
 		s.SendResponse(r)
+		return
+	}
+
+	s.iMu.Lock()
+	ctx, cancel := context.WithCancel(s.ctx)
+	inv := &invocation{cancel: cancel}
+	s.invokes[req.Rid] = inv
+	s.iMu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		n.Invoke(ctx, req)
+
+		// The rid may have been reused by a later invocation once this one
+		// was closed, so only this invocation is removed.
+		s.iMu.Lock()
+		if s.invokes[req.Rid] == inv {
+			delete(s.invokes, req.Rid)
+		}
+		s.iMu.Unlock()
+		cancel()
+	}()
+}
+
+func (s *Provider) handleSet(req *dslink.Request) {
+	r := dslink.NewResp(req.Rid)
+	r.Stream = dslink.StreamClosed
+	if path, name, ok := splitMetaPath(req.Path); ok {
+		if n := s.GetNode(path); n == nil {
+			r.Error = dslink.ErrInvalidPath
+		} else {
+			r.Error = n.setMeta(req, name)
+		}
+	} else if n := s.GetNode(req.Path); n == nil {
+		r.Error = dslink.ErrInvalidPath
+	} else {
+		r.Error = n.Set(req)
+	}
+	s.SendResponse(r)
+}
+
+// handleRemove removes the attribute or config addressed by the path of req, such
+// as /node/@name. Nodes themselves cannot be removed.
+func (s *Provider) handleRemove(req *dslink.Request) {
+	r := dslink.NewResp(req.Rid)
+	r.Stream = dslink.StreamClosed
+	if path, name, ok := splitMetaPath(req.Path); !ok {
+		r.Error = dslink.ErrInvalidMethod
+	} else if n := s.GetNode(path); n == nil {
+		r.Error = dslink.ErrInvalidPath
+	} else {
+		r.Error = n.removeMeta(req, name)
 	}
+	s.SendResponse(r)
 }
 
 // NewProvider returns a new Provider which is a simple implementation of the Provider and Node interfaces.
@@ -196,6 +386,12 @@ func NewProvider(resp chan<- *dslink.Response) *Provider {
 		cache:       make(map[string]*LocalNode),
 		listResp:    make(map[int32]dslink.Lister),
 		subscribers: make(map[int32]dslink.Valued),
+		qos:         make(map[int32]uint8),
+		invokes:     make(map[int32]*invocation),
+		ctx:         context.Background(),
+		dirty:       make(chan struct{}, 1),
+		profiles:    make(map[string]Profile),
+		flushes:     make(map[*LocalNode]bool),
 		lMu:         sync.Mutex{},
 		sMu:         sync.RWMutex{},
 		cMu:         sync.RWMutex{},
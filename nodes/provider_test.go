@@ -0,0 +1,234 @@
+package nodes
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/butlermatt/dslink"
+)
+
+func TestProviderCancelInvoke(t *testing.T) {
+	resp := make(chan *dslink.Response)
+	p := NewProvider(resp)
+	ctx, cancel := context.WithCancel(context.Background())
+	p.SetContext(ctx)
+
+	started := make(chan struct{})
+	n := NewNode("Action", p)
+	n.AddAction(func(ctx context.Context, params map[string]interface{}, ret chan<- []interface{}) {
+		defer close(ret)
+		close(started)
+		<-ctx.Done()
+	}, nil, nil, dslink.ResultStream)
+	p.GetRoot().AddChild(n)
+
+	req := dslink.NewReq(1, dslink.MethodInvoke)
+	req.Path = "/Action"
+	req.Permit = string(dslink.PermWrite)
+	p.HandleRequest(req)
+	<-started
+
+	p.HandleRequest(dslink.NewReq(1, dslink.MethodClose))
+	waitProvider(t, p)
+
+	req = dslink.NewReq(2, dslink.MethodInvoke)
+	req.Path = "/Action"
+	req.Permit = string(dslink.PermWrite)
+	started = make(chan struct{})
+	p.HandleRequest(req)
+	<-started
+
+	cancel()
+	waitProvider(t, p)
+}
+
+func TestProviderInvokeReusedRid(t *testing.T) {
+	p := NewProvider(make(chan *dslink.Response, 10))
+	release := make(chan struct{})
+	started := make(chan bool)
+	n := NewNode("Action", p)
+	first := true
+	n.AddAction(func(ctx context.Context, params map[string]interface{}, ret chan<- []interface{}) {
+		defer close(ret)
+		f := first
+		first = false
+		started <- f
+		<-ctx.Done()
+		if f {
+			<-release
+		}
+	}, nil, nil, dslink.ResultStream)
+	p.GetRoot().AddChild(n)
+
+	invoke := func() {
+		req := dslink.NewReq(1, dslink.MethodInvoke)
+		req.Path = "/Action"
+		req.Permit = string(dslink.PermWrite)
+		p.HandleRequest(req)
+		<-started
+	}
+	invoke()
+	p.HandleRequest(dslink.NewReq(1, dslink.MethodClose))
+	// The rid is reused while the first invocation is still returning.
+	invoke()
+	close(release)
+	time.Sleep(20 * time.Millisecond)
+
+	p.HandleRequest(dslink.NewReq(1, dslink.MethodClose))
+	waitProvider(t, p)
+}
+
+func waitProvider(t *testing.T, p *Provider) {
+	done := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Provider did not stop in-flight invocations")
+	}
+}
+
+func TestLocalNodeSetCoerce(t *testing.T) {
+	p := NewProvider(make(chan *dslink.Response))
+	n := NewNode("Setpoint", p)
+	p.GetRoot().AddChild(n)
+	n.SetType(dslink.ValueNum)
+	var got interface{}
+	n.EnableSet(dslink.PermWrite, func(_ dslink.Node, v interface{}) bool {
+		got = v
+		return true
+	})
+
+	req := dslink.NewReq(1, dslink.MethodSet)
+	req.Path = "/Setpoint"
+	req.Permit = string(dslink.PermWrite)
+	req.Value = "hot"
+	err := n.Set(req)
+	if err == nil || err.Type != dslink.ErrInvalidValue.Type || err.Msg == "" {
+		t.Fatalf("Set(%q) == %v, want %s with a message", req.Value, err, dslink.ErrInvalidValue.Type)
+	}
+	if got != nil || n.Value() != nil {
+		t.Errorf("Invalid value %q was set", req.Value)
+	}
+
+	req.Value = float64(20)
+	if err := n.Set(req); err != nil {
+		t.Fatalf("Set(%v) returned error: %v", req.Value, err)
+	}
+	if got != float64(20) || n.Value() != float64(20) {
+		t.Errorf("Set(%v) set %#v, want %#v", req.Value, n.Value(), float64(20))
+	}
+}
+
+func TestLocalNodePermission(t *testing.T) {
+	p := NewProvider(make(chan *dslink.Response))
+	root := p.GetRoot()
+	root.SetConfig(dslink.ConfigPermissions, map[string]dslink.PermType{
+		DefaultPermit: dslink.PermList,
+		"operator":    dslink.PermNever,
+	})
+	area := NewNode("Area", p)
+	root.AddChild(area)
+	// Restored from nodes.json, or set by a requester, in the DSA list form.
+	area.SetConfig(dslink.ConfigPermissions, []interface{}{
+		[]interface{}{"dashboard", "read"},
+	})
+	n := NewNode("Sensor", p)
+	area.AddChild(n)
+
+	cases := []struct {
+		permit string
+		want   dslink.PermType
+	}{
+		{"", dslink.PermList},
+		{"dashboard", dslink.PermRead},
+		{"operator", dslink.PermConfig},
+		{"write", dslink.PermList},
+		{"unknown", dslink.PermList},
+	}
+	for _, c := range cases {
+		if got := n.Permission(c.permit); got != c.want {
+			t.Errorf("Permission(%q) == %q, want %q", c.permit, got, c.want)
+		}
+	}
+	// Without $$permissions a permit naming a permission is trusted, as it was
+	// set by the broker, and any other permit gets the least privilege.
+	detached := NewNode("Detached", p)
+	if got := detached.Permission(""); got != dslink.PermNone {
+		t.Errorf("Permission(\"\") without $$permissions == %q, want %q", got, dslink.PermNone)
+	}
+	if got := detached.Permission("unknown"); got != dslink.PermNone {
+		t.Errorf("Permission(\"unknown\") without $$permissions == %q, want %q", got, dslink.PermNone)
+	}
+	if got := detached.Permission("read"); got != dslink.PermRead {
+		t.Errorf("Permission(\"read\") without $$permissions == %q, want %q", got, dslink.PermRead)
+	}
+	p.SetDefaultPermission(dslink.PermConfig)
+	if got := detached.Permission(""); got != dslink.PermConfig {
+		t.Errorf("Permission(\"\") with a default of %q == %q", dslink.PermConfig, got)
+	}
+	if got := detached.Permission("read"); got != dslink.PermRead {
+		t.Errorf("Permission(\"read\") with a default of %q == %q", dslink.PermConfig, got)
+	}
+	p.SetDefaultPermission(dslink.PermNone)
+	// Once $$permissions is set, permits without an entry get no permission.
+	detached.SetConfig(dslink.ConfigPermissions, map[string]string{"dashboard": "read"})
+	if got := detached.Permission("config"); got != dslink.PermNone {
+		t.Errorf("Permission(\"config\") without a matching entry == %q, want %q", got, dslink.PermNone)
+	}
+
+	open := NewNode("Open", p)
+	root.AddChild(open)
+	open.SetConfig(dslink.ConfigPermissions, map[string]string{DefaultPermit: "read"})
+
+	req := dslink.NewReq(1, dslink.MethodSub)
+	req.Paths = []*dslink.SubPath{{Path: "/Open", Sid: 2}, {Path: "/Area/Sensor", Sid: 1}}
+	if r := p.HandleRequest(req); r.Error != dslink.ErrPermissionDenied {
+		t.Errorf("Subscribe without a permit returned %v, want %v", r.Error, dslink.ErrPermissionDenied)
+	}
+	if p.Qos(2) != 0 || len(open.subscribers) != 0 {
+		t.Error("Subscribe which was denied subscribed to the other paths")
+	}
+	req.Permit = "dashboard"
+	if r := p.HandleRequest(req); r.Error != nil {
+		t.Errorf("Subscribe with a read permit returned %v", r.Error)
+	}
+
+	req = dslink.NewReq(2, dslink.MethodList)
+	req.Path = "/Area"
+	r := p.HandleRequest(req)
+	for _, u := range r.Updates {
+		if lu, _ := u.([]interface{}); lu[0] == dslink.ConfigPermissions {
+			t.Errorf("List without the config permission returned %v", lu)
+		}
+	}
+}
+
+func TestProviderReset(t *testing.T) {
+	resp := make(chan *dslink.Response, 10)
+	p := NewProvider(resp)
+	n := NewNode("Value", p)
+	p.GetRoot().AddChild(n)
+
+	list := dslink.NewReq(1, dslink.MethodList)
+	list.Path = "/Value"
+	list.Permit = string(dslink.PermRead)
+	p.HandleRequest(list)
+	sub := dslink.NewReq(2, dslink.MethodSub)
+	sub.Paths = []*dslink.SubPath{{Path: "/Value", Sid: 3, Qos: 2}}
+	sub.Permit = string(dslink.PermRead)
+	p.HandleRequest(sub)
+
+	p.Reset()
+	if len(p.listResp) != 0 || len(n.listSubs) != 0 {
+		t.Error("Reset() kept the list streams")
+	}
+	if len(p.subscribers) != 0 || len(n.subscribers) != 0 || p.Qos(3) != 0 {
+		t.Error("Reset() kept the subscriptions")
+	}
+}
@@ -102,16 +102,16 @@ func (n *RemoteNode) GetChild(p string) *RemoteNode {
 	return n.chdn[p]
 }
 
-func (n *RemoteNode) Type() dslink.ValueType {
-	t := n.conf[dslink.ConfigType]
-	if t == nil {
-		return ""
-	}
-	vt, ok := t.(string)
-	if !ok {
-		return ""
-	}
-	return dslink.ValueType(vt)
+// Type returns the type of the value of the node, from its $type config and its
+// @unit and @precision attributes.
+func (n *RemoteNode) Type() dslink.Type {
+	n.cMu.RLock()
+	vt, _ := n.conf[dslink.ConfigType].(string)
+	n.cMu.RUnlock()
+
+	n.aMu.RLock()
+	defer n.aMu.RUnlock()
+	return dslink.TypeOf(dslink.ValueType(vt), n.attr)
 }
 
 func NewRemoteNode(p string) *RemoteNode {
@@ -1,6 +1,7 @@
 package nodes
 
 import (
+	"context"
 	"sync"
 	"errors"
 	"github.com/butlermatt/dslink"
@@ -15,21 +16,70 @@ type Requester struct {
 	rMu sync.Mutex
 	rid int32
 	cMu sync.RWMutex
-	cache map[int32]chan *dslink.Response
+	cache map[int32]*openRequest
 	c   chan<- *dslink.Request
+	ctx context.Context
+}
+
+// openRequest is a request waiting for responses. Its channel is only closed once
+// no response is being delivered to it.
+type openRequest struct {
+	c    chan *dslink.Response
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// close stops the delivery of responses to the request and closes its channel.
+func (o *openRequest) close() {
+	close(o.done)
+	o.wg.Wait()
+	close(o.c)
 }
 
 func NewRequester(reqChan chan<-*dslink.Request) *Requester {
-	return &Requester{c: reqChan, cache: make(map[int32]chan *dslink.Response)}
+	return &Requester{c: reqChan, cache: make(map[int32]*openRequest), ctx: context.Background()}
+}
+
+// SetContext sets the context which controls the lifetime of the Requester. Once ctx is
+// cancelled, requests are no longer sent and responses are no longer delivered.
+func (r *Requester) SetContext(ctx context.Context) {
+	r.cMu.Lock()
+	defer r.cMu.Unlock()
+	r.ctx = ctx
+}
+
+func (r *Requester) context() context.Context {
+	r.cMu.RLock()
+	defer r.cMu.RUnlock()
+	return r.ctx
 }
 
 func (r *Requester) HandleResponse(resp *dslink.Response) {
 	log.Debug.Printf("Received response with RID: %d", resp.Rid)
+	// The delivery is registered while the request is still open, so it is
+	// closed only after the delivery has finished.
 	r.cMu.RLock()
-	c := r.cache[resp.Rid]
+	o := r.cache[resp.Rid]
+	if o != nil {
+		o.wg.Add(1)
+	}
 	r.cMu.RUnlock()
 
-	c<- resp
+	if o == nil {
+		log.Debug.Printf("No open request for RID: %d", resp.Rid)
+		return
+	}
+
+	select {
+	case o.c<- resp:
+		o.wg.Done()
+	case <-o.done:
+		o.wg.Done()
+		return
+	case <-r.context().Done():
+		o.wg.Done()
+		return
+	}
 	if resp.Stream == dslink.StreamClosed {
 		r.deleteRid(resp.Rid)
 	}
@@ -37,23 +87,45 @@ func (r *Requester) HandleResponse(resp *dslink.Response) {
 
 func (r *Requester) SendRequest(req *dslink.Request, c chan *dslink.Response) {
 	r.cMu.Lock()
-	r.cache[req.Rid] = c
+	r.cache[req.Rid] = &openRequest{c: c, done: make(chan struct{})}
 	r.cMu.Unlock()
 
-	r.c <- req
+	select {
+	case r.c <- req:
+	case <-r.context().Done():
+	}
 }
 
 func (r *Requester) CloseRequest(rid int32) {
 	req := dslink.NewReq(rid, dslink.MethodClose)
-	r.c <- req
+	select {
+	case r.c <- req:
+	case <-r.context().Done():
+	}
 	r.deleteRid(rid)
 }
 
+// CloseAll closes the response channels of all open requests. It is called when the
+// connection to the broker is lost or the link has stopped, as no further responses
+// to the open requests can arrive.
+func (r *Requester) CloseAll() {
+	r.cMu.Lock()
+	open := r.cache
+	r.cache = make(map[int32]*openRequest)
+	r.cMu.Unlock()
+	for _, o := range open {
+		o.close()
+	}
+}
+
 func (r *Requester) deleteRid(rid int32) {
 	r.cMu.Lock()
-	defer r.cMu.Unlock()
-	close(r.cache[rid])
+	o, ok := r.cache[rid]
 	delete(r.cache, rid)
+	r.cMu.Unlock()
+	if ok {
+		o.close()
+	}
 }
 
 func (r *Requester) getRid() int32 {
@@ -102,7 +174,10 @@ func (r *Requester) GetRemoteNode(path string) (*RemoteNode, error) {
 
 	r.SendRequest(req, rChan)
 
-	resp := <-rChan
+	resp, ok := <-rChan
+	if !ok {
+		return nil, errors.New("Request closed before a response was received")
+	}
 
 	// TODO Check resp for errors!
 	if resp.Error != nil {
@@ -147,11 +222,14 @@ func (r *Requester) GetRemoteNode(path string) (*RemoteNode, error) {
 			}
 
 			req := dslink.NewReq(r.getRid(), dslink.MethodList)
-			req.Path = "/def/profile/" + isT
+			req.Path = profilePath + "/" + isT
 			isChan := make(chan *dslink.Response)
 
 			r.SendRequest(req, isChan)
-			resp := <-isChan
+			resp, ok := <-isChan
+			if !ok {
+				return nil, errors.New("Request closed before a response was received")
+			}
 			r.CloseRequest(req.Rid)
 			for _, u := range resp.Updates {
 				up, ok := u.([]interface{})
@@ -0,0 +1,32 @@
+package nodes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/butlermatt/dslink"
+)
+
+func TestRequesterCloseAllDuringResponse(t *testing.T) {
+	r := NewRequester(make(chan *dslink.Request, 1))
+	c := make(chan *dslink.Response)
+	r.SendRequest(dslink.NewReq(1, dslink.MethodList), c)
+
+	// The response is in flight, as nothing reads c yet.
+	handled := make(chan struct{})
+	go func() {
+		r.HandleResponse(dslink.NewResp(1))
+		close(handled)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	r.CloseAll()
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("HandleResponse did not return after CloseAll")
+	}
+	if _, ok := <-c; ok {
+		t.Error("CloseAll did not close the response channel")
+	}
+}
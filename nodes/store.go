@@ -0,0 +1,261 @@
+package nodes
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/butlermatt/dslink"
+	"github.com/butlermatt/dslink/log"
+)
+
+// valueKey is the key of a node's value in nodes.json.
+const valueKey = "?value"
+
+// requestedKey is the key of the list of attributes and configs of a node which
+// requesters have set or removed in nodes.json.
+const requestedKey = "?requested"
+
+// saveDelay is how long AutoSave waits after a change to the node tree
+// before saving it, so that a burst of changes results in a single save.
+var saveDelay = time.Second
+
+// Serialize returns the node and its children in the nodes.json format. Configs
+// and attributes are stored under their names, which start with $ and @
+// respectively, the value under ?value, the names of those set or removed by
+// requesters under ?requested and each child under its name. The profile
+// definitions under /defs are left out, as the link publishes them again.
+func (n *LocalNode) Serialize() map[string]interface{} {
+	m := make(map[string]interface{})
+
+	n.aMu.RLock()
+	for k, v := range n.conf {
+		m[string(k)] = v
+	}
+	for k, v := range n.attr {
+		m[k] = v
+	}
+	if len(n.requested) > 0 {
+		req := make([]string, 0, len(n.requested))
+		for k := range n.requested {
+			req = append(req, k)
+		}
+		sort.Strings(req)
+		m[requestedKey] = req
+	}
+	n.aMu.RUnlock()
+
+	if v := n.Value(); v != nil {
+		m[valueKey] = v
+	}
+
+	n.cMu.RLock()
+	for name, c := range n.chld {
+		if c.transient {
+			continue
+		}
+		m[name] = c.Serialize()
+	}
+	n.cMu.RUnlock()
+
+	return m
+}
+
+// restore applies the contents of m, in the nodes.json format, to the node.
+// The values set up by the link win: an attribute or config which the node
+// already has, as set by the link or by the node's profile, is only replaced
+// if a requester set it while the link ran, and removed if a requester removed
+// it. Other attributes and configs, the value and children which do not exist
+// yet are restored, so changes made by requesters outlive the link.
+func (n *LocalNode) restore(m map[string]interface{}) {
+	requested := make(map[string]bool)
+	names, _ := m[requestedKey].([]interface{})
+	n.aMu.Lock()
+	for _, v := range names {
+		k, ok := v.(string)
+		if !ok || k == "" || linkConfigs[dslink.NodeConfig(k)] {
+			continue
+		}
+		requested[k] = true
+		if n.requested == nil {
+			n.requested = make(map[string]bool)
+		}
+		n.requested[k] = true
+		if _, ok := m[k]; ok {
+			continue
+		}
+		delete(n.attr, k)
+		delete(n.conf, dslink.NodeConfig(k))
+		if dslink.NodeConfig(k) == dslink.ConfigType {
+			n.valType = ""
+		}
+	}
+	n.aMu.Unlock()
+
+	for k, v := range m {
+		switch {
+		case strings.HasPrefix(k, "$"):
+			n.aMu.Lock()
+			if _, ok := n.conf[dslink.NodeConfig(k)]; ok && !requested[k] {
+				n.aMu.Unlock()
+				continue
+			}
+			n.conf[dslink.NodeConfig(k)] = v
+			switch dslink.NodeConfig(k) {
+			case dslink.ConfigType:
+				t, _ := v.(string)
+				n.valType = dslink.ValueType(t)
+			case dslink.ConfigColumns:
+				n.columns = nil
+				cols, _ := v.([]interface{})
+				for _, c := range cols {
+					if cm, ok := c.(map[string]interface{}); ok {
+						n.columns = append(n.columns, cm)
+					}
+				}
+			}
+			n.aMu.Unlock()
+		case strings.HasPrefix(k, "@"):
+			n.aMu.Lock()
+			if _, ok := n.attr[k]; !ok || requested[k] {
+				n.attr[k] = v
+			}
+			n.aMu.Unlock()
+		case k == requestedKey:
+		case k == valueKey:
+			n.vMu.Lock()
+			n.value = v
+			n.vMu.Unlock()
+		default:
+			cm, ok := v.(map[string]interface{})
+			if !ok {
+				log.Warn.Printf("Unable to restore node %s/%s: %v\n", n.path, k, v)
+				continue
+			}
+			n.cMu.RLock()
+			c := n.chld[k]
+			n.cMu.RUnlock()
+			if c == nil {
+				c = n.restoreChild(k, cm)
+			}
+			c.restore(cm)
+		}
+	}
+}
+
+// markDirty records that the node tree has changed since it was last saved.
+func (s *Provider) markDirty() {
+	select {
+	case s.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// Save writes the node tree to the file at path in the nodes.json format. The
+// file is replaced atomically, so it is never left partially written.
+func (s *Provider) Save(path string) error {
+	d, err := json.MarshalIndent(s.root.Serialize(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(d)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Load restores the node tree from the file at path, which was written by Save.
+// Nodes which already exist keep their callbacks and the attributes and configs
+// set up by the link, except those changed by requesters, and have the others,
+// their value and missing children restored. Other nodes are created and
+// set up by the profile registered for their $is, if any.
+func (s *Provider) Load(path string) error {
+	// The tree matches the file once it is loaded, or is new if there is
+	// no file, so earlier changes do not need to be saved.
+	defer func() {
+		select {
+		case <-s.dirty:
+		default:
+		}
+	}()
+
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(d, &m); err != nil {
+		return err
+	}
+	s.root.restore(m)
+	return nil
+}
+
+// AutoSave saves the node tree to the file at path until ctx is cancelled. The
+// tree is saved a second after it changes, every interval to save the values
+// updated by the link and changes the Provider was not notified of, and once
+// more when ctx is cancelled if it has changed since it was last saved. An
+// interval of 0 disables the periodic saves.
+func (s *Provider) AutoSave(ctx context.Context, path string, interval time.Duration) {
+	var periodic <-chan time.Time
+	if interval > 0 {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		periodic = tick.C
+	}
+
+	var delay *time.Timer
+	var due <-chan time.Time
+	dirty := false
+	save := func() {
+		if err := s.Save(path); err != nil {
+			log.Error.Printf("Unable to save nodes to %s: %v\n", path, err)
+		}
+		dirty = false
+		if delay != nil {
+			delay.Stop()
+			due = nil
+		}
+	}
+
+	for {
+		select {
+		case <-s.dirty:
+			dirty = true
+			if due == nil {
+				delay = time.NewTimer(saveDelay)
+				due = delay.C
+			}
+		case <-due:
+			due = nil
+			save()
+		case <-periodic:
+			save()
+		case <-ctx.Done():
+			if dirty {
+				save()
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package nodes
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/butlermatt/dslink"
+)
+
+func TestProviderSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.json")
+
+	p := NewProvider(make(chan *dslink.Response))
+	p.GetRoot().SetConfig(dslink.ConfigPermissions, map[string]dslink.PermType{DefaultPermit: dslink.PermRead, "admin": dslink.PermConfig})
+	n := NewNode("Setting", p)
+	p.GetRoot().AddChild(n)
+	n.SetType(dslink.ValueNum)
+	n.EnableSet(dslink.PermWrite, func(dslink.Node, interface{}) bool { return true })
+	n.SetAttribute("@note", "set by the link")
+	n.SetAttribute("@unit", "C")
+	n.UpdateValue(21.5)
+	// A requester changed $writable and removed @note while the link ran.
+	req := dslink.NewReq(1, dslink.MethodSet)
+	req.Permit = "admin"
+	req.Path = "/Setting/$writable"
+	req.Value = "read"
+	if err := n.setMeta(req, string(dslink.ConfigWritable)); err != nil {
+		t.Fatalf("Set $writable returned error: %v", err)
+	}
+	req.Path = "/Setting/@note"
+	if err := n.removeMeta(req, "@note"); err != nil {
+		t.Fatalf("Remove @note returned error: %v", err)
+	}
+
+	created := NewNode("Created", p)
+	n.AddChild(created)
+	created.SetConfig(dslink.ConfigName, "Created at runtime")
+	created.UpdateValue("hello")
+
+	if err := p.Save(path); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Dir(path))
+	if len(files) != 1 {
+		t.Errorf("Save left %d files, want only nodes.json", len(files))
+	}
+
+	// The link sets up its own nodes before the tree is restored.
+	p2 := NewProvider(make(chan *dslink.Response))
+	p2.GetRoot().SetConfig(dslink.ConfigPermissions, map[string]dslink.PermType{DefaultPermit: dslink.PermWrite})
+	called := false
+	n2 := NewNode("Setting", p2)
+	p2.GetRoot().AddChild(n2)
+	n2.SetType(dslink.ValueNum)
+	n2.EnableSet(dslink.PermWrite, func(dslink.Node, interface{}) bool {
+		called = true
+		return true
+	})
+	n2.SetAttribute("@note", "set by the link")
+
+	if err := p2.Load(path); err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if v := n2.Value(); v != 21.5 {
+		t.Errorf("Value() == %v, want %v", v, 21.5)
+	}
+	if a, _ := n2.GetAttribute("@unit"); a != "C" {
+		t.Errorf("Attribute @unit == %v, want %v", a, "C")
+	}
+	if w, _ := n2.GetConfig(dslink.ConfigWritable); toPerm(w) != dslink.PermRead {
+		t.Errorf("$writable == %v, want the persisted %v", w, dslink.PermRead)
+	}
+	if a, ok := n2.GetAttribute("@note"); ok {
+		t.Errorf("Attribute @note == %v, want it removed as by the requester", a)
+	}
+	// Only changes made by requesters replace what the link sets up.
+	if got := p2.GetRoot().Permission(""); got != dslink.PermWrite {
+		t.Errorf("Permission(\"\") == %q, want %q set by the link", got, dslink.PermWrite)
+	}
+	n2.onSet(n2, 1)
+	if !called {
+		t.Error("Load replaced the OnSetValue callback")
+	}
+
+	c := p2.GetNode("/Setting/Created")
+	if c == nil {
+		t.Fatal("Load did not create /Setting/Created")
+	}
+	if name, _ := c.GetConfig(dslink.ConfigName); name != "Created at runtime" {
+		t.Errorf("$name == %v, want %v", name, "Created at runtime")
+	}
+	if v := c.Value(); v != "hello" {
+		t.Errorf("Value() == %v, want %v", v, "hello")
+	}
+}
+
+func TestProviderValueChanges(t *testing.T) {
+	p := NewProvider(make(chan *dslink.Response))
+	n := NewNode("Value", p)
+	p.GetRoot().AddChild(n)
+	n.SetType(dslink.ValueNum)
+	n.EnableSet(dslink.PermWrite, nil)
+	<-p.dirty
+
+	// Values updated by the link are left to the periodic save.
+	n.UpdateValue(1)
+	select {
+	case <-p.dirty:
+		t.Error("UpdateValue marked the node tree as changed")
+	default:
+	}
+
+	req := dslink.NewReq(1, dslink.MethodSet)
+	req.Permit = string(dslink.PermWrite)
+	req.Value = 2
+	if err := n.Set(req); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	select {
+	case <-p.dirty:
+	default:
+		t.Error("Set by a requester did not mark the node tree as changed")
+	}
+}
+
+func TestProviderAutoSave(t *testing.T) {
+	saveDelay = 10 * time.Millisecond
+	defer func() { saveDelay = time.Second }()
+
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	p := NewProvider(make(chan *dslink.Response))
+	if err := p.Load(path); err == nil {
+		t.Fatal("Load of missing file did not return an error")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.AutoSave(ctx, path, 0)
+		close(done)
+	}()
+
+	p.GetRoot().AddChild(NewNode("Saved", p))
+	deadline := time.Now().Add(time.Second)
+	for {
+		if d, err := ioutil.ReadFile(path); err == nil && len(d) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Node tree was not saved after a change")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Changes still pending are saved when the context is cancelled.
+	p.GetRoot().AddChild(NewNode("Pending", p))
+	cancel()
+	<-done
+
+	p2 := NewProvider(make(chan *dslink.Response))
+	if err := p2.Load(path); err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	for _, path := range []string{"/Saved", "/Pending"} {
+		if p2.GetNode(path) == nil {
+			t.Errorf("Node %s was not saved", path)
+		}
+	}
+}
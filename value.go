@@ -0,0 +1,289 @@
+package dslink
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// binaryPrefix starts the strings which hold binary values in the DSA json encoding,
+// followed by the bytes in base64.
+const binaryPrefix = "\x1bbytes:"
+
+// Attributes holding metadata about the value of a node.
+const (
+	// AttrUnit is the unit of the value, such as "°C".
+	AttrUnit = "@unit"
+	// AttrPrecision is the number of decimal places the value is shown with.
+	AttrPrecision = "@precision"
+)
+
+// Type is the structured form of a ValueType, along with the metadata about the
+// value which is published in the attributes of its node.
+type Type struct {
+	// Kind is the type without its options, such as ValueNum or ValueEnum.
+	Kind ValueType
+	// Enum lists the options of an enum.
+	Enum []string
+	// Unit is the unit of the value, published as @unit.
+	Unit string
+	// Precision is the number of decimal places the value is shown with, published
+	// as @precision. It is nil if not set.
+	Precision *int
+}
+
+// ParseType parses the value type t, such as "num" or "enum[on,off]". Types
+// unknown to this package are kept as the Kind. It returns an error if an enum is
+// malformed.
+func ParseType(t ValueType) (Type, error) {
+	pt := Type{Kind: t}
+	s := string(t)
+	if !strings.HasPrefix(s, string(ValueEnum)) || s == string(ValueEnum) {
+		return pt, nil
+	}
+	if !strings.HasPrefix(s, "enum[") || !strings.HasSuffix(s, "]") {
+		return pt, fmt.Errorf("invalid enum type %q", s)
+	}
+	pt.Kind = ValueEnum
+	if opts := s[len("enum[") : len(s)-1]; opts != "" {
+		pt.Enum = strings.Split(opts, ",")
+	}
+	return pt, nil
+}
+
+// TypeOf returns the Type of a node with the value type t and the attributes attrs,
+// which holds its @unit and @precision. A malformed type is kept as the Kind.
+func TypeOf(t ValueType, attrs map[string]interface{}) Type {
+	pt, err := ParseType(t)
+	if err != nil {
+		pt = Type{Kind: t}
+	}
+	pt.Unit, _ = attrs[AttrUnit].(string)
+	if i, ok := toInt(attrs[AttrPrecision]); ok && i >= 0 {
+		p := int(i)
+		pt.Precision = &p
+	}
+	return pt
+}
+
+// ValueType returns the value type published in the $type config of a node.
+func (t Type) ValueType() ValueType {
+	if t.Kind == ValueEnum {
+		return GenerateEnumValue(t.Enum...)
+	}
+	return t.Kind
+}
+
+func (t Type) String() string {
+	return string(t.ValueType())
+}
+
+// Attributes returns the @unit and @precision attributes of a node of type t. Those
+// which are not set are left out.
+func (t Type) Attributes() map[string]interface{} {
+	m := make(map[string]interface{})
+	if t.Unit != "" {
+		m[AttrUnit] = t.Unit
+	}
+	if t.Precision != nil {
+		m[AttrPrecision] = *t.Precision
+	}
+	return m
+}
+
+// Coerce validates v as a value of type t and converts it to the form stored by a
+// node. See Type.Coerce. Values of malformed types are returned unchanged.
+func (t ValueType) Coerce(v interface{}) (interface{}, error) {
+	pt, err := ParseType(t)
+	if err != nil {
+		return v, nil
+	}
+	return pt.Coerce(v)
+}
+
+// Coerce validates v as a value of type t and converts it to the form stored by a
+// node, so values decoded from json and msgpack are handled alike:
+//
+//	bool     a bool, or a string such as "true" or "false"
+//	num      a float64 which is neither NaN nor infinite. Numeric strings are parsed.
+//	int      an int64, including whole float64s. Numeric strings are parsed.
+//	string   a string. Numbers and bools are formatted.
+//	map      a map[string]interface{}
+//	array    a []interface{}
+//	time     a string in the RFC 3339 format. A time.Time is formatted.
+//	binary   a []byte, or a string holding the bytes in the DSA json encoding
+//	enum     a string which is one of the Enum options
+//
+// A nil value is valid for every type. Values of dynamic and unknown types are
+// returned unchanged. It returns an error describing why v is not valid otherwise.
+func (t Type) Coerce(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	switch t.Kind {
+	case ValueBool:
+		switch b := v.(type) {
+		case bool:
+			return b, nil
+		case string:
+			if p, err := strconv.ParseBool(b); err == nil {
+				return p, nil
+			}
+		}
+	case ValueNum:
+		f, ok := toFloat(v)
+		if s, isStr := v.(string); isStr {
+			var err error
+			f, err = strconv.ParseFloat(s, 64)
+			ok = err == nil
+		}
+		if ok && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return f, nil
+		}
+	case ValueInt:
+		if i, ok := toInt(v); ok {
+			return i, nil
+		}
+		if s, ok := v.(string); ok {
+			if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return i, nil
+			}
+		}
+	case ValueString:
+		switch s := v.(type) {
+		case string:
+			return s, nil
+		case bool:
+			return strconv.FormatBool(s), nil
+		}
+		if _, ok := toFloat(v); ok {
+			return fmt.Sprint(v), nil
+		}
+	case ValueMap:
+		switch m := v.(type) {
+		case map[string]interface{}:
+			return m, nil
+		case map[interface{}]interface{}:
+			// msgpack decodes maps with interface{} keys.
+			sm := make(map[string]interface{}, len(m))
+			for k, e := range m {
+				ks, ok := k.(string)
+				if !ok {
+					return nil, fmt.Errorf("%#v is not a valid key of a map value", k)
+				}
+				sm[ks] = e
+			}
+			return sm, nil
+		}
+	case ValueArray:
+		if a, ok := v.([]interface{}); ok {
+			return a, nil
+		}
+	case ValueTime:
+		switch tm := v.(type) {
+		case time.Time:
+			return tm.Format(time.RFC3339Nano), nil
+		case string:
+			if _, err := time.Parse(time.RFC3339Nano, tm); err == nil {
+				return tm, nil
+			}
+		}
+	case ValueBinary:
+		switch b := v.(type) {
+		case []byte:
+			return b, nil
+		case string:
+			if strings.HasPrefix(b, binaryPrefix) {
+				if d, err := base64.StdEncoding.DecodeString(b[len(binaryPrefix):]); err == nil {
+					return d, nil
+				}
+			}
+		}
+	case ValueEnum:
+		if s, ok := v.(string); ok {
+			for _, o := range t.Enum {
+				if s == o {
+					return s, nil
+				}
+			}
+			return nil, fmt.Errorf("%q is not one of %s", s, strings.Join(t.Enum, ", "))
+		}
+	default:
+		return v, nil
+	}
+
+	return nil, fmt.Errorf("%#v is not a valid %s value", v, t)
+}
+
+// toFloat converts the numeric types decoded from json and msgpack to a float64.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// toInt converts the integer types decoded from json and msgpack to an int64.
+// As json decodes every number as a float64, whole float64s which fit are
+// converted as well.
+func toInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint:
+		return toInt(uint64(n))
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		if n > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(n), true
+	case float32:
+		return toInt(float64(n))
+	case float64:
+		if n == math.Trunc(n) && math.Abs(n) <= 1<<53 {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,152 @@
+package dslink
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValueTypeCoerce(t *testing.T) {
+	enum := GenerateEnumValue("on", "off")
+	cases := []struct {
+		t    ValueType
+		v    interface{}
+		want interface{}
+	}{
+		{ValueBool, true, true},
+		{ValueBool, "false", false},
+		{ValueNum, float64(21), float64(21)},
+		{ValueNum, int8(21), float64(21)},
+		{ValueNum, uint64(7), float64(7)},
+		{ValueNum, 21.5, 21.5},
+		{ValueNum, float32(0.5), 0.5},
+		{ValueNum, "42", float64(42)},
+		{ValueNum, "4.25", 4.25},
+		{ValueString, "text", "text"},
+		{ValueString, 21.5, "21.5"},
+		{ValueString, true, "true"},
+		{ValueMap, map[interface{}]interface{}{"a": 1}, map[string]interface{}{"a": 1}},
+		{ValueArray, []interface{}{1, "a"}, []interface{}{1, "a"}},
+		{enum, "off", "off"},
+		{ValueInt, float64(3), int64(3)},
+		{ValueInt, uint8(3), int64(3)},
+		{ValueString, int64(3), "3"},
+		{ValueInt, "-3", int64(-3)},
+		{ValueTime, "2026-10-17T12:00:00Z", "2026-10-17T12:00:00Z"},
+		{ValueTime, time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC), "2026-10-17T12:00:00Z"},
+		{ValueBinary, "\x1bbytes:AQI=", []byte{1, 2}},
+		{ValueDynamic, "anything", "anything"},
+		{ValueNum, nil, nil},
+	}
+	for _, c := range cases {
+		got, err := c.t.Coerce(c.v)
+		if err != nil {
+			t.Errorf("%s.Coerce(%#v) returned error: %v", c.t, c.v, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s.Coerce(%#v) == %#v, want %#v", c.t, c.v, got, c.want)
+		}
+	}
+
+	invalid := []struct {
+		t ValueType
+		v interface{}
+	}{
+		{ValueBool, 1},
+		{ValueBool, "maybe"},
+		{ValueNum, "twelve"},
+		{ValueNum, "NaN"},
+		{ValueNum, math.NaN()},
+		{ValueNum, math.Inf(1)},
+		{ValueNum, "-Inf"},
+		{ValueNum, true},
+		{ValueString, []interface{}{"a"}},
+		{ValueMap, map[interface{}]interface{}{1: "a"}},
+		{ValueMap, "a"},
+		{ValueArray, map[string]interface{}{}},
+		{ValueInt, 2.5},
+		{ValueTime, "yesterday"},
+		{ValueBinary, "AQI="},
+		{enum, "dim"},
+		{enum, 1},
+	}
+	for _, c := range invalid {
+		if got, err := c.t.Coerce(c.v); err == nil {
+			t.Errorf("%s.Coerce(%#v) == %#v, want an error", c.t, c.v, got)
+		}
+	}
+}
+
+func TestParseType(t *testing.T) {
+	cases := []struct {
+		t    ValueType
+		want Type
+	}{
+		{ValueNum, Type{Kind: ValueNum}},
+		{ValueBinary, Type{Kind: ValueBinary}},
+		{GenerateEnumValue("on", "off"), Type{Kind: ValueEnum, Enum: []string{"on", "off"}}},
+		{"enum[]", Type{Kind: ValueEnum}},
+		{"custom", Type{Kind: "custom"}},
+	}
+	for _, c := range cases {
+		got, err := ParseType(c.t)
+		if err != nil {
+			t.Errorf("ParseType(%q) returned error: %v", c.t, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ParseType(%q) == %#v, want %#v", c.t, got, c.want)
+		}
+		if vt := got.ValueType(); vt != c.t {
+			t.Errorf("ParseType(%q).ValueType() == %q", c.t, vt)
+		}
+	}
+	if got, _ := ParseType("binary"); got.Kind != ValueBinary || got.ValueType() != "binary" {
+		t.Errorf("ParseType(\"binary\") == %#v, want kind %q published as binary", got, ValueBinary)
+	}
+	if _, err := ParseType("enum[on,off"); err == nil {
+		t.Error("ParseType of a malformed enum did not return an error")
+	}
+
+	// Precision decoded from json is a float64.
+	typ := TypeOf(ValueNum, map[string]interface{}{AttrUnit: "°C", AttrPrecision: float64(1)})
+	if typ.Unit != "°C" || typ.Precision == nil || *typ.Precision != 1 {
+		t.Errorf("TypeOf() == %#v, want unit °C and precision 1", typ)
+	}
+	if a := typ.Attributes(); !reflect.DeepEqual(a, map[string]interface{}{AttrUnit: "°C", AttrPrecision: 1}) {
+		t.Errorf("Attributes() == %v", a)
+	}
+	// A zero Type has no precision, while a precision of 0 is published.
+	if a := (Type{Kind: ValueNum}).Attributes(); len(a) != 0 {
+		t.Errorf("Attributes() of a zero Type == %v, want none", a)
+	}
+	zero := 0
+	if a := (Type{Kind: ValueNum, Precision: &zero}).Attributes(); a[AttrPrecision] != 0 {
+		t.Errorf("Attributes() with precision 0 == %v", a)
+	}
+}
+
+func TestPermTypeAllows(t *testing.T) {
+	if PermRead.Level() != 1 || PermConfig.Level() != 3 || PermNever.Level() != 4 {
+		t.Error("Levels of the existing permissions changed")
+	}
+	cases := []struct {
+		p, need PermType
+		want    bool
+	}{
+		{PermList, PermList, true},
+		{PermList, PermRead, false},
+		{PermNone, PermList, false},
+		{PermRead, PermList, true},
+		{PermConfig, PermWrite, true},
+		{PermConfig, PermNever, false},
+		{"bogus", PermNone, false},
+	}
+	for _, c := range cases {
+		if got := c.p.Allows(c.need); got != c.want {
+			t.Errorf("%q.Allows(%q) == %v, want %v", c.p, c.need, got, c.want)
+		}
+	}
+}